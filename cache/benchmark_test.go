@@ -46,3 +46,30 @@ func BenchmarkCacheGet(b *testing.B) {
 		}
 	}
 }
+
+func benchmarkParallelGet(b *testing.B, c cache.Cache) {
+	item := testItem{size: 10}
+	for i := 0; i < 10000; i++ {
+		_ = c.Put(strconv.Itoa(i), item, item.ByteSize())
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := c.Get(strconv.Itoa(i % 10000)); !ok {
+				b.Errorf("Could not fetch %d", i%10000)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkCacheParallelGet(b *testing.B) {
+	benchmarkParallelGet(b, cache.New(10000000, 0))
+}
+
+func BenchmarkShardedCacheParallelGet(b *testing.B) {
+	benchmarkParallelGet(b, cache.NewSharded(16, 10000000, 0, 0, cache.NewLruPolicy))
+}
@@ -1,7 +1,6 @@
 package cache
 
 import (
-	"container/list"
 	"fmt"
 	"sync"
 	"time"
@@ -10,108 +9,633 @@ import (
 
 type Cache interface {
 	Put(key string, item interface{}, byteSize int) error
+	PutWithTTL(key string, item interface{}, byteSize int, ttl time.Duration) error
 	Get(key string) (interface{}, bool)
+	Update(key string, fn func(item interface{}) (interface{}, int, error)) (bool, error)
+	Delete(key string) bool
+	EvictExpired() int
+	Entries() []Entry
+	Walk(fn func(Entry) bool)
+	WalkMeta(fn func(Entry) bool)
+	Restore(entry Entry) (bool, error)
 	Stats() CacheStats
 }
 
+// Entry is an exported copy of an entry in the cache.
+type Entry struct {
+	Key        string
+	Item       interface{}
+	ByteSize   int // Size of the item as given when it was stored
+	CreateTime time.Time
+	TTL        time.Duration // 0 = use the max age of the cache
+	LastAccess time.Time     // Zero if never accessed
+	HitCount   int
+}
+
+// HasExpired returns true if the entry is older than its TTL or, if it
+// has no TTL, older than maxAge.
+func (e Entry) HasExpired(maxAge time.Duration) bool {
+	return hasExpired(e.CreateTime, e.TTL, maxAge)
+}
+
+// ExpiresIn returns the time left until the entry expires given maxAge.
+// Returns false if the entry never expires.
+func (e Entry) ExpiresIn(maxAge time.Duration) (time.Duration, bool) {
+	if e.TTL > 0 {
+		maxAge = e.TTL
+	}
+
+	if maxAge <= 0 {
+		return 0, false
+	}
+
+	return maxAge - time.Since(e.CreateTime), true
+}
+
+func hasExpired(createTime time.Time, ttl, maxAge time.Duration) bool {
+	if ttl > 0 {
+		maxAge = ttl
+	}
+	return maxAge > 0 && time.Since(createTime) > maxAge
+}
+
 // 16 bytes for string head
-// 8 for pointer to element
+// 8 for pointer to entry
 // 40 bytes map entry overhead estimate for now (see https://stackoverflow.com/questions/15313105/memory-overhead-of-maps-in-go)
 const mapEntrySize = 16 + 8 + 40
 
 const maxStatHistory = 1000
 
+// LruCache is a size bounded cache. Despite the name the eviction policy is
+// pluggable, LRU is the default.
 type LruCache struct {
-	lock              *sync.Mutex
-	keyMap            map[string]*list.Element // mapEntrySize / entry
-	lruList           *list.List
-	maxSize           int
-	currentSize       int
-	maxAge            time.Duration
-	timesToEviction   []time.Duration
-	ageEvictionCount  int
-	sizeEvictionCount int
-	replaceCount      int
-	lastStat          time.Time
+	lock               *sync.Mutex
+	keyMap             map[string]*cacheEntry // mapEntrySize / entry
+	policy             EvictionPolicy
+	spill              SpillTier
+	spilling           map[string]*cacheEntry // Evicted entries on their way to the spill tier
+	keyLocks           map[string]*keyLock
+	maxSize            int
+	maxCount           int
+	currentSize        int
+	maxAge             time.Duration
+	timesToEviction    []time.Duration
+	ageEvictionCount   int
+	sizeEvictionCount  int
+	countEvictionCount int
+	replaceCount       int
+	deleteCount        int
+	spillHitCount      int
+	spillMissCount     int
+	lastStat           time.Time
 }
 
 type cacheEntry struct {
-	// 40 byte overhead for the Element
+	// 40 byte overhead for the bookkeeping in the eviction policy
 	item       interface{}
 	createTime time.Time
 	key        string
 	size       int
+	ttl        time.Duration // 0 = use the max age of the cache
+	lastAccess time.Time
+	hitCount   int
+}
+
+// See cacheEntry definition for the reasoning behind the below numbers
+func entryOverhead(key string) int {
+	return 40 + int(unsafe.Sizeof(cacheEntry{})) + len(key) + mapEntrySize
 }
 
-func newCacheEntry(key string, item interface{}, itemSize int) cacheEntry {
+func newCacheEntry(key string, item interface{}, itemSize int, ttl time.Duration, createTime time.Time) cacheEntry {
 	return cacheEntry{
 		item:       item,
-		createTime: time.Now(),
+		createTime: createTime,
 		key:        key,
-		// See struct definition for the reasoning behind the below numbers
-		size: 40 + int(unsafe.Sizeof(cacheEntry{})) + len(key) + itemSize + mapEntrySize,
+		ttl:        ttl,
+		size:       entryOverhead(key) + itemSize,
 	}
 }
 
 func (ce *cacheEntry) hasExpired(maxAge time.Duration) bool {
-	return maxAge > 0 && time.Since(ce.createTime) > maxAge
+	return hasExpired(ce.createTime, ce.ttl, maxAge)
+}
+
+func (ce *cacheEntry) export() Entry {
+	return Entry{
+		Key:        ce.key,
+		Item:       ce.item,
+		ByteSize:   ce.size - entryOverhead(ce.key),
+		CreateTime: ce.createTime,
+		TTL:        ce.ttl,
+		LastAccess: ce.lastAccess,
+		HitCount:   ce.hitCount,
+	}
+}
+
+func (ce *cacheEntry) accessed() {
+	ce.lastAccess = time.Now()
+	ce.hitCount++
+}
+
+// keyLock orders the spill tier operations for a key with the changes of the
+// key in memory. It must be acquired before the cache lock.
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey acquires the key lock for key and returns a function that releases
+// it. Key locks are only needed, and only taken, when there is a spill tier.
+func (c *LruCache) lockKey(key string) func() {
+	if c.spill == nil {
+		return func() {}
+	}
+
+	c.lock.Lock()
+	kl, ok := c.keyLocks[key]
+	if !ok {
+		kl = &keyLock{}
+		c.keyLocks[key] = kl
+	}
+	kl.refs++
+	c.lock.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		c.lock.Lock()
+		kl.refs--
+		if kl.refs == 0 {
+			delete(c.keyLocks, key)
+		}
+		c.lock.Unlock()
+	}
+}
+
+// SetSpillTier makes the cache move entries evicted because of size or count
+// limits to tier rather than dropping them. Entries not found in memory are looked
+// for in tier and moved back into memory if found.
+// Must be called before the cache is used.
+func (c *LruCache) SetSpillTier(tier SpillTier) {
+	c.spill = tier
 }
 
 func (c *LruCache) Put(key string, item interface{}, byteSize int) error {
+	return c.PutWithTTL(key, item, byteSize, 0)
+}
+
+// PutWithTTL stores item under key. A ttl > 0 overrides the max age of
+// the cache for this entry.
+func (c *LruCache) PutWithTTL(key string, item interface{}, byteSize int, ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("ttl must not be negative, was: %v", ttl)
+	}
+
+	return c.replace(newCacheEntry(key, item, byteSize, ttl, time.Now()))
+}
+
+// replace stores newEntry in memory and removes any previous version of it
+// from the spill tier.
+func (c *LruCache) replace(newEntry cacheEntry) error {
+	unlock := c.lockKey(newEntry.key)
 	c.lock.Lock()
-	defer c.lock.Unlock()
+	evicted, err := c.put(newEntry)
+	c.lock.Unlock()
+
+	if c.spill != nil {
+		// Any previously spilled version of the entry is stale now
+		c.spill.Delete(newEntry.key)
+	}
+	unlock()
+
+	c.spillEntries(evicted)
+	return err
+}
 
-	if elem, ok := c.keyMap[key]; ok {
-		c.remove(elem, false)
+// Restore stores an entry previously returned by Entries, keeping its
+// creation time. Entries that have already expired are ignored.
+// Returns true if the entry was stored.
+func (c *LruCache) Restore(entry Entry) (bool, error) {
+	if entry.TTL < 0 {
+		return false, fmt.Errorf("ttl must not be negative, was: %v", entry.TTL)
+	}
+
+	newEntry := newCacheEntry(entry.Key, entry.Item, entry.ByteSize, entry.TTL, entry.CreateTime)
+	if newEntry.hasExpired(c.maxAge) {
+		return false, nil
+	}
+
+	err := c.replace(newEntry)
+	return err == nil, err
+}
+
+// Stores newEntry, returns the entries evicted to make room for it. Evicted
+// entries are registered as spilling and must be passed to spillEntries once
+// the lock has been released.
+func (c *LruCache) put(newEntry cacheEntry) ([]*cacheEntry, error) {
+	// Checked up front to leave any existing entry untouched if newEntry
+	// would not fit even with all other entries evicted
+	if newEntry.size > c.maxSize-cacheOverhead {
+		return nil, fmt.Errorf("cannot fit %d bytes in cache", newEntry.size)
+	}
+
+	key := newEntry.key
+	if entry, ok := c.keyMap[key]; ok {
+		c.remove(entry, false)
 		c.replaceCount++
 	}
 
-	newEntry := newCacheEntry(key, item, byteSize)
+	// A spilling version of the entry is stale now
+	delete(c.spilling, key)
+
+	var evicted []*cacheEntry
 
 	// Evict old entries if needed to fit new entry in cache
 	for c.currentSize+newEntry.size > c.maxSize {
-		elem := c.lruList.Back()
-		removed := c.remove(elem, true)
-		if !removed {
-			return fmt.Errorf("cannot fit %d bytes in cache", newEntry.size)
+		entry := c.evict()
+		if entry == nil {
+			return evicted, fmt.Errorf("cannot fit %d bytes in cache", newEntry.size)
 		}
+		evicted = append(evicted, c.spillable(entry))
 		c.sizeEvictionCount++
 	}
 
-	elem := c.lruList.PushFront(newEntry)
-	c.keyMap[key] = elem
+	// Evict old entries if needed to stay within the max number of entries
+	for c.maxCount > 0 && len(c.keyMap) >= c.maxCount {
+		evicted = append(evicted, c.spillable(c.evict()))
+		c.countEvictionCount++
+	}
+
+	c.keyMap[key] = &newEntry
+	c.policy.Added(key)
 	c.currentSize += newEntry.size
-	return nil
+	return evicted, nil
+}
+
+// spillable registers the evicted entry as spilling. Until it has been stored
+// in the spill tier it is still found by Get.
+func (c *LruCache) spillable(entry *cacheEntry) *cacheEntry {
+	if c.spill != nil {
+		c.spilling[entry.key] = entry
+	}
+	return entry
+}
+
+// Moves evicted entries to the spill tier, must not be called with the lock held.
+// Entries that have been replaced or deleted since they were evicted are skipped.
+func (c *LruCache) spillEntries(entries []*cacheEntry) {
+	if c.spill == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		unlock := c.lockKey(entry.key)
+		c.lock.Lock()
+		current := c.spilling[entry.key] == entry
+		exported := entry.export()
+		c.lock.Unlock()
+
+		if current {
+			// Errors are ignored, the entry is dropped just as if there was no spill tier
+			_ = c.spill.Store(exported)
+		}
+
+		c.lock.Lock()
+		if c.spilling[entry.key] == entry {
+			delete(c.spilling, entry.key)
+		}
+		c.lock.Unlock()
+		unlock()
+	}
 }
 
 func (c *LruCache) Get(key string) (interface{}, bool) {
 	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	elem, ok := c.keyMap[key]
+	entry, ok := c.keyMap[key]
 	if !ok {
-		return nil, false
+		if item, ok := c.getSpilling(key); ok {
+			c.lock.Unlock()
+			return item, true
+		}
+
+		c.lock.Unlock()
+		if c.spill == nil {
+			return nil, false
+		}
+		item, ok, _ := c.promote(key)
+		return item, ok
 	}
+	defer c.lock.Unlock()
 
-	entry := elem.Value.(cacheEntry)
 	if entry.hasExpired(c.maxAge) {
-		c.remove(elem, true)
+		c.remove(entry, true)
 		c.ageEvictionCount++
 		return nil, false
 	}
 
-	c.lruList.MoveToFront(elem)
+	c.policy.Accessed(key)
+	entry.accessed()
+	return entry.item, true
+}
+
+// getSpilling returns the item of an entry evicted but not yet stored in the
+// spill tier. Must be called with the lock held.
+func (c *LruCache) getSpilling(key string) (interface{}, bool) {
+	entry, ok := c.spilling[key]
+	if !ok || entry.hasExpired(c.maxAge) {
+		return nil, false
+	}
+
+	entry.accessed()
 	return entry.item, true
 }
 
+// Moves the entry stored under key from the spill tier, or from the entries
+// on their way there, into memory, if present. The item is returned even if it does not
+// fit in memory, it is then kept in the spill tier and the error is returned.
+func (c *LruCache) promote(key string) (interface{}, bool, error) {
+	unlock := c.lockKey(key)
+
+	c.lock.Lock()
+	if entry, ok := c.keyMap[key]; ok {
+		// Stored, or promoted, while waiting for the key lock
+		c.policy.Accessed(key)
+		entry.accessed()
+		c.lock.Unlock()
+		unlock()
+		return entry.item, true, nil
+	}
+
+	if entry, ok := c.spilling[key]; ok && !entry.hasExpired(c.maxAge) {
+		entry.accessed()
+		evicted, err := c.put(*entry)
+		if err != nil {
+			// Leave it to be spilled
+			c.spilling[key] = entry
+		}
+		c.lock.Unlock()
+		unlock()
+		c.spillEntries(evicted)
+		return entry.item, true, err
+	}
+	c.lock.Unlock()
+
+	spilled, ok := c.spill.Load(key)
+
+	c.lock.Lock()
+	if !ok {
+		c.spillMissCount++
+		c.lock.Unlock()
+		unlock()
+		return nil, false, nil
+	}
+
+	c.spillHitCount++
+	newEntry := newCacheEntry(key, spilled.Item, spilled.ByteSize, spilled.TTL, spilled.CreateTime)
+	newEntry.hitCount = spilled.HitCount
+	newEntry.accessed()
+	if newEntry.hasExpired(c.maxAge) {
+		c.ageEvictionCount++
+		c.lock.Unlock()
+		unlock()
+		return nil, false, nil
+	}
+
+	evicted, err := c.put(newEntry)
+	c.lock.Unlock()
+
+	if err != nil {
+		// Does not fit in memory, put it back rather than losing it
+		_ = c.spill.Store(spilled)
+	}
+
+	// The key lock must not be held while spilling since that takes other key locks
+	unlock()
+	c.spillEntries(evicted)
+	return newEntry.item, true, err
+}
+
+// Update replaces the item stored under key with the item, and its byte size,
+// returned by fn when called with the current item. The entry keeps its TTL and
+// creation time but is otherwise treated as a new entry. Returns false if there
+// is no entry stored under key. If fn returns an error, or the new item does not
+// fit in the cache, the entry is left untouched.
+//
+// fn is called without the lock held. If the entry is replaced while fn is
+// running fn is called again with the new item, no updates are lost.
+func (c *LruCache) Update(key string, fn func(item interface{}) (interface{}, int, error)) (bool, error) {
+	for {
+		c.lock.Lock()
+		entry, ok := c.keyMap[key]
+		if ok && entry.hasExpired(c.maxAge) {
+			c.remove(entry, true)
+			c.ageEvictionCount++
+			ok = false
+		}
+
+		var hitCount int
+		var lastAccess time.Time
+		if ok {
+			hitCount, lastAccess = entry.hitCount, entry.lastAccess
+		}
+		c.lock.Unlock()
+
+		if !ok {
+			if c.spill == nil {
+				return false, nil
+			}
+
+			if _, ok, err := c.promote(key); !ok || err != nil {
+				return ok, err
+			}
+			continue
+		}
+
+		item, byteSize, err := fn(entry.item)
+		if err != nil {
+			return true, err
+		}
+
+		newEntry := newCacheEntry(key, item, byteSize, entry.ttl, entry.createTime)
+		newEntry.hitCount, newEntry.lastAccess = hitCount, lastAccess
+
+		c.lock.Lock()
+		if c.keyMap[key] != entry {
+			// Replaced while fn was running, try again
+			c.lock.Unlock()
+			continue
+		}
+
+		evicted, err := c.put(newEntry)
+		c.lock.Unlock()
+		c.spillEntries(evicted)
+		return true, err
+	}
+}
+
+// Delete removes the entry stored under key. Returns true if the
+// entry existed, false otherwise.
+func (c *LruCache) Delete(key string) bool {
+	unlock := c.lockKey(key)
+	defer unlock()
+
+	c.lock.Lock()
+	entry, ok := c.keyMap[key]
+	if ok {
+		c.remove(entry, false)
+		c.deleteCount++
+	} else if _, spilling := c.spilling[key]; spilling {
+		delete(c.spilling, key)
+		c.deleteCount++
+		ok = true
+	}
+	c.lock.Unlock()
+
+	if c.spill != nil && c.spill.Delete(key) && !ok {
+		c.lock.Lock()
+		c.deleteCount++
+		c.lock.Unlock()
+		ok = true
+	}
+
+	return ok
+}
+
+// EvictExpired removes all expired entries from the cache, not only those
+// that have been requested. Returns the number of evicted entries.
+func (c *LruCache) EvictExpired() int {
+	count := c.evictExpiredInMemory()
+	if c.spill != nil {
+		count += c.spill.EvictExpired(c.maxAge)
+	}
+
+	return count
+}
+
+func (c *LruCache) evictExpiredInMemory() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	count := 0
+	for _, entry := range c.keyMap {
+		if entry.hasExpired(c.maxAge) {
+			c.remove(entry, true)
+			c.ageEvictionCount++
+			count++
+		}
+	}
+
+	return count
+}
+
+// Entries returns a copy of all entries, in memory and in the spill tier.
+func (c *LruCache) Entries() []Entry {
+	result := make([]Entry, 0)
+	c.Walk(func(e Entry) bool {
+		result = append(result, e)
+		return true
+	})
+
+	return result
+}
+
+// Walk calls fn for each entry, in memory and in the spill tier, until fn
+// returns false. The lock is only held while copying each entry, not while
+// calling fn, so entries added or removed during the walk may or may not be visited.
+func (c *LruCache) Walk(fn func(Entry) bool) {
+	visited := make(map[string]struct{})
+	if c.walkMemory(fn, visited) {
+		walkSpill(c.spill, false, c.maxAge, fn, visited)
+	}
+}
+
+// WalkMeta is like Walk but the items of entries in the spill tier are not
+// read, see SpillTier.WalkMeta.
+func (c *LruCache) WalkMeta(fn func(Entry) bool) {
+	visited := make(map[string]struct{})
+	if c.walkMemory(fn, visited) {
+		walkSpill(c.spill, true, c.maxAge, fn, visited)
+	}
+}
+
+// walkMemory calls fn for each entry in memory, including those on their way
+// to the spill tier, and adds their keys to visited. Returns false if fn did.
+func (c *LruCache) walkMemory(fn func(Entry) bool, visited map[string]struct{}) bool {
+	c.lock.Lock()
+	keys := make([]string, 0, len(c.keyMap)+len(c.spilling))
+	for key := range c.keyMap {
+		keys = append(keys, key)
+	}
+	for key := range c.spilling {
+		keys = append(keys, key)
+	}
+	c.lock.Unlock()
+
+	for _, key := range keys {
+		c.lock.Lock()
+		entry, ok := c.keyMap[key]
+		if !ok {
+			entry, ok = c.spilling[key]
+		}
+		ok = ok && !entry.hasExpired(c.maxAge)
+		var exported Entry
+		if ok {
+			exported = entry.export()
+		}
+		c.lock.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		if _, seen := visited[key]; seen {
+			continue
+		}
+		visited[key] = struct{}{}
+
+		if !fn(exported) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// walkSpill calls fn for each unexpired entry in tier with a key not in visited.
+// The items of the entries are only read if meta is false.
+func walkSpill(tier SpillTier, meta bool, maxAge time.Duration, fn func(Entry) bool, visited map[string]struct{}) {
+	if tier == nil {
+		return
+	}
+
+	walk := tier.Walk
+	if meta {
+		walk = tier.WalkMeta
+	}
+
+	walk(func(e Entry) bool {
+		if _, seen := visited[e.Key]; seen || e.HasExpired(maxAge) {
+			return true
+		}
+		visited[e.Key] = struct{}{}
+		return fn(e)
+	})
+}
+
 type CacheStats struct {
-	TimeToEviction []time.Duration
-	ByteSize       int
-	ItemCount      int
-	AgeEvictCount  int
-	SizeEvictCount int
-	ReplaceCount   int
-	StatDuration   time.Duration
+	TimeToEviction  []time.Duration
+	ByteSize        int
+	ItemCount       int
+	AgeEvictCount   int
+	SizeEvictCount  int
+	CountEvictCount int
+	ReplaceCount    int
+	DeleteCount     int
+	SpillHitCount   int
+	SpillMissCount  int
+	SpillByteSize   int
+	SpillItemCount  int
+	StatDuration    time.Duration
 }
 
 func (c *LruCache) Stats() CacheStats {
@@ -121,62 +645,92 @@ func (c *LruCache) Stats() CacheStats {
 
 	lastStat := time.Now()
 	stat := CacheStats{
-		TimeToEviction: c.timesToEviction,
-		ByteSize:       c.currentSize,
-		ItemCount:      len(c.keyMap),
-		AgeEvictCount:  c.ageEvictionCount,
-		SizeEvictCount: c.sizeEvictionCount,
-		ReplaceCount:   c.replaceCount,
-		StatDuration:   lastStat.Sub(c.lastStat),
+		TimeToEviction:  c.timesToEviction,
+		ByteSize:        c.currentSize,
+		ItemCount:       len(c.keyMap),
+		AgeEvictCount:   c.ageEvictionCount,
+		SizeEvictCount:  c.sizeEvictionCount,
+		CountEvictCount: c.countEvictionCount,
+		ReplaceCount:    c.replaceCount,
+		DeleteCount:     c.deleteCount,
+		SpillHitCount:   c.spillHitCount,
+		SpillMissCount:  c.spillMissCount,
+		StatDuration:    lastStat.Sub(c.lastStat),
+	}
+	if c.spill != nil {
+		spillStats := c.spill.Stats()
+		stat.SpillByteSize = spillStats.ByteSize
+		stat.SpillItemCount = spillStats.ItemCount
 	}
 	c.lastStat = lastStat
 	c.timesToEviction = newTimesToEviction
 	c.ageEvictionCount = 0
 	c.sizeEvictionCount = 0
+	c.countEvictionCount = 0
 	c.replaceCount = 0
+	c.deleteCount = 0
+	c.spillHitCount = 0
+	c.spillMissCount = 0
 	return stat
 }
 
-// Returns true if the element is removed, false otherwise
-func (c *LruCache) remove(elem *list.Element, isEvicted bool) bool {
-	if elem == nil {
-		return false
+// Evicts the entry selected by the eviction policy. Returns the evicted
+// entry, nil if the cache is empty.
+func (c *LruCache) evict() *cacheEntry {
+	key, ok := c.policy.Victim()
+	if !ok {
+		return nil
 	}
 
-	entry := elem.Value.(cacheEntry)
+	entry := c.keyMap[key]
+	c.remove(entry, true)
+	return entry
+}
+
+func (c *LruCache) remove(entry *cacheEntry, isEvicted bool) {
 	timeToEviction := time.Since(entry.createTime)
 	if isEvicted && len(c.timesToEviction) < maxStatHistory {
 		c.timesToEviction = append(c.timesToEviction, timeToEviction)
 	}
 
 	delete(c.keyMap, entry.key)
-	c.lruList.Remove(elem)
+	c.policy.Removed(entry.key, isEvicted)
 	c.currentSize -= entry.size
-	return true
 }
 
+// Rough estimate of the overhead of the cache structure itself
+const cacheOverhead = int(unsafe.Sizeof(LruCache{}))
+
 // Don't allow cache sizes less than 1 Mb to avoid edge cases
 // with very small caches.
 const minMaxSize = 1000000
 
+// New creates a new LRU cache that holds at most maxSize bytes.
 func New(maxSize int, maxAge time.Duration) *LruCache {
+	return NewWithPolicy(maxSize, 0, maxAge, NewLruPolicy())
+}
+
+// NewWithPolicy creates a new cache like New that uses policy to decide which
+// entries to evict. If maxCount > 0 the cache also holds at most maxCount entries.
+func NewWithPolicy(maxSize, maxCount int, maxAge time.Duration, policy EvictionPolicy) *LruCache {
 	if maxSize <= minMaxSize {
 		maxSize = minMaxSize
 	}
 
 	return &LruCache{
-		lock:    &sync.Mutex{},
-		keyMap:  make(map[string]*list.Element),
-		lruList: list.New(),
-		maxSize: maxSize,
-		maxAge:  maxAge,
-		// Rough estimate of the overhead of this structure
-		currentSize: int(unsafe.Sizeof(LruCache{})),
+		lock:        &sync.Mutex{},
+		keyMap:      make(map[string]*cacheEntry),
+		spilling:    make(map[string]*cacheEntry),
+		keyLocks:    make(map[string]*keyLock),
+		policy:      policy,
+		maxSize:     maxSize,
+		maxCount:    maxCount,
+		maxAge:      maxAge,
+		currentSize: cacheOverhead,
 		lastStat:    time.Now()}
 }
 
 // TODO: Make thread safety optional?
-// TODO: In addition to byte size make it possible to set a maxCount
 // TODO: Make maximum history size configurable
 // TODO: Move to own repo?
 // TODO: Count number of history entries that could not be written because of overflow
@@ -1,8 +1,10 @@
 package cache_test
 
 import (
+	"fmt"
 	"github.com/tobgu/qocache/cache"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -122,7 +124,7 @@ func TestMaxAgeIsRespected(t *testing.T) {
 
 	stats := c.Stats()
 	assertTrue(t, stats.ItemCount == 1)
-	assertEquals(t, baseStats.ByteSize+269, stats.ByteSize)
+	assertEquals(t, baseStats.ByteSize+309, stats.ByteSize)
 
 	time.Sleep(1 * time.Millisecond)
 
@@ -189,3 +191,505 @@ func TestLruProperty(t *testing.T) {
 	assertTrue(t, ok)
 
 }
+
+func TestDelete(t *testing.T) {
+	c := cache.New(1000000, 0)
+	baseStats := c.Stats()
+
+	assertNotErr(t, c.Put("1", testItem{size: 100}, 100))
+	assertTrue(t, c.Delete("1"))
+
+	_, ok := c.Get("1")
+	assertFalse(t, ok)
+
+	// Deleting a non existing key is reported as such
+	assertFalse(t, c.Delete("1"))
+
+	stats := c.Stats()
+	assertEquals(t, 0, stats.ItemCount)
+	assertEquals(t, baseStats.ByteSize, stats.ByteSize)
+	assertEquals(t, 1, stats.DeleteCount)
+	assertEquals(t, 0, stats.SizeEvictCount)
+	assertEquals(t, 0, len(stats.TimeToEviction))
+}
+
+func TestTTLOverridesMaxAge(t *testing.T) {
+	c := cache.New(1000000, time.Hour)
+
+	assertNotErr(t, c.PutWithTTL("short", testItem{}, 100, time.Nanosecond))
+	assertNotErr(t, c.PutWithTTL("long", testItem{}, 100, 2*time.Hour))
+	assertNotErr(t, c.Put("default", testItem{}, 100))
+	assertTrue(t, c.PutWithTTL("negative", testItem{}, 100, -time.Second) != nil)
+
+	time.Sleep(1 * time.Millisecond)
+
+	_, ok := c.Get("short")
+	assertFalse(t, ok)
+	_, ok = c.Get("long")
+	assertTrue(t, ok)
+	_, ok = c.Get("default")
+	assertTrue(t, ok)
+
+	stats := c.Stats()
+	assertEquals(t, 2, stats.ItemCount)
+	assertEquals(t, 1, stats.AgeEvictCount)
+}
+
+func TestEvictExpired(t *testing.T) {
+	c := cache.New(1000000, time.Hour)
+	baseStats := c.Stats()
+
+	assertNotErr(t, c.PutWithTTL("1", testItem{}, 100, time.Nanosecond))
+	assertNotErr(t, c.Put("2", testItem{}, 100))
+	assertNotErr(t, c.PutWithTTL("3", testItem{}, 100, time.Nanosecond))
+
+	time.Sleep(1 * time.Millisecond)
+	assertEquals(t, 2, c.EvictExpired())
+
+	stats := c.Stats()
+	assertEquals(t, 1, stats.ItemCount)
+	assertEquals(t, 2, stats.AgeEvictCount)
+	assertEquals(t, 2, len(stats.TimeToEviction))
+
+	_, ok := c.Get("2")
+	assertTrue(t, ok)
+	assertTrue(t, stats.ByteSize > baseStats.ByteSize)
+}
+
+func TestSweeperEvictsExpiredEntries(t *testing.T) {
+	c := cache.New(1000000, time.Nanosecond)
+	assertNotErr(t, c.Put("1", testItem{}, 100))
+
+	s := cache.StartSweeper(c, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	s.Stop()
+
+	stats := c.Stats()
+	assertEquals(t, 0, stats.ItemCount)
+	assertEquals(t, 1, stats.AgeEvictCount)
+}
+
+func TestMaxCountIsRespected(t *testing.T) {
+	c := cache.NewWithPolicy(1000000, 2, 0, cache.NewLruPolicy())
+
+	assertNotErr(t, c.Put("1", testItem{}, 100))
+	assertNotErr(t, c.Put("2", testItem{}, 100))
+	_, ok := c.Get("1")
+	assertTrue(t, ok)
+
+	// Replacing an existing entry does not evict anything
+	assertNotErr(t, c.Put("2", testItem{}, 100))
+	assertNotErr(t, c.Put("3", testItem{}, 100))
+
+	// "1" least recently used since "2" was replaced after "1" was read
+	_, ok = c.Get("1")
+	assertFalse(t, ok)
+	_, ok = c.Get("2")
+	assertTrue(t, ok)
+	_, ok = c.Get("3")
+	assertTrue(t, ok)
+
+	stats := c.Stats()
+	assertEquals(t, 2, stats.ItemCount)
+	assertEquals(t, 1, stats.CountEvictCount)
+	assertEquals(t, 0, stats.SizeEvictCount)
+}
+
+func TestShardedCache(t *testing.T) {
+	c := cache.NewSharded(4, 8000000, 0, 0, cache.NewLruPolicy)
+	baseStats := c.Stats()
+
+	for i := 0; i < 100; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), testItem{size: i}, 100))
+	}
+
+	for i := 0; i < 100; i++ {
+		item, ok := c.Get(strconv.Itoa(i))
+		assertTrue(t, ok)
+		assertEquals(t, i, item.(testItem).size)
+	}
+
+	assertTrue(t, c.Delete("1"))
+	assertFalse(t, c.Delete("1"))
+
+	stats := c.Stats()
+	assertEquals(t, 99, stats.ItemCount)
+	assertEquals(t, 1, stats.DeleteCount)
+	assertTrue(t, stats.ByteSize > baseStats.ByteSize+99*100)
+}
+
+func TestShardedCacheLimitsAreSplitBetweenShards(t *testing.T) {
+	maxSize := 8000000
+	c := cache.NewSharded(4, maxSize, 40, 0, cache.NewLruPolicy)
+	item := testItem{size: 100000}
+
+	insertCount := 100
+	for i := 0; i < insertCount; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), item, item.ByteSize()))
+	}
+
+	stats := c.Stats()
+	assertTrue(t, stats.ByteSize <= maxSize)
+	assertTrue(t, stats.ItemCount <= 40)
+	assertEquals(t, insertCount-stats.ItemCount, stats.CountEvictCount+stats.SizeEvictCount)
+
+	// Each shard can hold 10 items, a single large item must
+	// fit within the budget of one shard.
+	largeItem := testItem{size: maxSize / 2}
+	assertTrue(t, c.Put("large", largeItem, largeItem.ByteSize()) != nil)
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	for _, name := range []string{"lru", "lfu", "arc"} {
+		t.Run(name, func(t *testing.T) {
+			newPolicy, err := cache.EvictionPolicyByName(name)
+			assertNotErr(t, err)
+			c := cache.NewWithPolicy(1000000, 10, 0, newPolicy())
+
+			for i := 0; i < 100; i++ {
+				assertNotErr(t, c.Put(strconv.Itoa(i), testItem{size: i}, 100))
+				_, ok := c.Get(strconv.Itoa(i))
+				assertTrue(t, ok)
+				if i%10 == 0 {
+					assertTrue(t, c.Delete(strconv.Itoa(i)))
+				}
+			}
+
+			stats := c.Stats()
+			assertEquals(t, 10, stats.ItemCount)
+			assertEquals(t, 10, stats.DeleteCount)
+			assertEquals(t, 80, stats.CountEvictCount)
+
+			// Items that can never fit do not evict anything
+			c = cache.NewWithPolicy(1000000, 0, 0, newPolicy())
+			assertNotErr(t, c.Put("1", testItem{}, 100))
+			assertTrue(t, c.Put("2", testItem{}, 1000000) != nil)
+			assertEquals(t, 1, c.Stats().ItemCount)
+		})
+	}
+
+	_, err := cache.EvictionPolicyByName("foo")
+	assertTrue(t, err != nil)
+}
+
+func TestLfuPolicyKeepsFrequentlyUsedEntries(t *testing.T) {
+	c := cache.NewWithPolicy(1000000, 3, 0, cache.NewLfuPolicy())
+	assertNotErr(t, c.Put("frequent", testItem{}, 100))
+	for i := 0; i < 5; i++ {
+		_, _ = c.Get("frequent")
+	}
+
+	for i := 0; i < 10; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), testItem{}, 100))
+		_, _ = c.Get(strconv.Itoa(i))
+	}
+
+	_, ok := c.Get("frequent")
+	assertTrue(t, ok)
+	_, ok = c.Get("9")
+	assertTrue(t, ok)
+	_, ok = c.Get("0")
+	assertFalse(t, ok)
+}
+
+func TestArcPolicyIsScanResistant(t *testing.T) {
+	c := cache.NewWithPolicy(1000000, 4, 0, cache.NewArcPolicy())
+	for _, key := range []string{"ref1", "ref2"} {
+		assertNotErr(t, c.Put(key, testItem{}, 100))
+		_, _ = c.Get(key)
+	}
+
+	// A scan of entries that are never read again does not push out
+	// the entries that have been used more than once.
+	for i := 0; i < 100; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), testItem{}, 100))
+	}
+
+	_, ok := c.Get("ref1")
+	assertTrue(t, ok)
+	_, ok = c.Get("ref2")
+	assertTrue(t, ok)
+	_, ok = c.Get("99")
+	assertTrue(t, ok)
+	_, ok = c.Get("0")
+	assertFalse(t, ok)
+
+	// With LRU on the other hand they are evicted
+	c = cache.NewWithPolicy(1000000, 4, 0, cache.NewLruPolicy())
+	for _, key := range []string{"ref1", "ref2"} {
+		assertNotErr(t, c.Put(key, testItem{}, 100))
+		_, _ = c.Get(key)
+	}
+
+	for i := 0; i < 100; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), testItem{}, 100))
+	}
+
+	_, ok = c.Get("ref1")
+	assertFalse(t, ok)
+}
+
+func TestEntriesAndRestore(t *testing.T) {
+	c := cache.New(1000000, time.Hour)
+	assertNotErr(t, c.PutWithTTL("1", testItem{size: 1}, 100, 2*time.Hour))
+	assertNotErr(t, c.PutWithTTL("2", testItem{size: 2}, 100, time.Nanosecond))
+	time.Sleep(1 * time.Millisecond)
+
+	entries := c.Entries()
+	assertEquals(t, 1, len(entries))
+	assertTrue(t, entries[0].Key == "1")
+	assertTrue(t, entries[0].TTL == 2*time.Hour)
+	assertEquals(t, 100, entries[0].ByteSize)
+
+	restored := cache.New(1000000, time.Hour)
+	ok, err := restored.Restore(entries[0])
+	assertTrue(t, ok)
+	assertNotErr(t, err)
+
+	// Expired entries are not restored
+	expired := cache.Entry{Key: "3", Item: testItem{}, ByteSize: 100, CreateTime: time.Now().Add(-2 * time.Hour)}
+	ok, err = restored.Restore(expired)
+	assertFalse(t, ok)
+	assertNotErr(t, err)
+
+	restoredEntries := restored.Entries()
+	assertEquals(t, 1, len(restoredEntries))
+	assertTrue(t, restoredEntries[0].CreateTime.Equal(entries[0].CreateTime))
+	item, ok := restored.Get("1")
+	assertTrue(t, ok)
+	assertEquals(t, 1, item.(testItem).size)
+}
+
+func TestEntriesIncludeSpilledEntries(t *testing.T) {
+	for name, c := range map[string]interface {
+		cache.Cache
+		SetSpillTier(tier cache.SpillTier)
+	}{
+		"lru":     cache.NewWithPolicy(1000000, 1, time.Hour, cache.NewLruPolicy()),
+		"sharded": cache.NewSharded(2, 2000000, 2, time.Hour, cache.NewLruPolicy),
+	} {
+		t.Run(name, func(t *testing.T) {
+			tier := &mapSpillTier{entries: map[string]cache.Entry{}}
+			c.SetSpillTier(tier)
+			for i := 1; i <= 4; i++ {
+				assertNotErr(t, c.Put(strconv.Itoa(i), testItem{size: i}, 100))
+			}
+			assertTrue(t, len(tier.entries) > 0)
+
+			sizes := 0
+			for _, e := range c.Entries() {
+				sizes += e.Item.(testItem).size
+			}
+			assertEquals(t, 1+2+3+4, sizes)
+
+			// Expired entries in the spill tier are not included
+			tier.entries["5"] = cache.Entry{Key: "5", Item: testItem{size: 5}, CreateTime: time.Now().Add(-2 * time.Hour)}
+			assertEquals(t, 4, len(c.Entries()))
+		})
+	}
+}
+
+type mapSpillTier struct {
+	entries map[string]cache.Entry
+}
+
+func (m *mapSpillTier) Store(entry cache.Entry) error {
+	m.entries[entry.Key] = entry
+	return nil
+}
+
+func (m *mapSpillTier) Load(key string) (cache.Entry, bool) {
+	entry, ok := m.entries[key]
+	delete(m.entries, key)
+	return entry, ok
+}
+
+func (m *mapSpillTier) Delete(key string) bool {
+	_, ok := m.entries[key]
+	delete(m.entries, key)
+	return ok
+}
+
+func (m *mapSpillTier) Walk(fn func(cache.Entry) bool) {
+	for _, entry := range m.entries {
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
+func (m *mapSpillTier) WalkMeta(fn func(cache.Entry) bool) {
+	m.Walk(func(e cache.Entry) bool {
+		e.Item = nil
+		return fn(e)
+	})
+}
+
+func (m *mapSpillTier) EvictExpired(maxAge time.Duration) int {
+	count := 0
+	for key, entry := range m.entries {
+		if entry.HasExpired(maxAge) {
+			delete(m.entries, key)
+			count++
+		}
+	}
+	return count
+}
+
+func (m *mapSpillTier) Stats() cache.SpillStats {
+	return cache.SpillStats{ItemCount: len(m.entries)}
+}
+
+func TestEvictedEntriesAreSpilledAndPromoted(t *testing.T) {
+	c := cache.NewWithPolicy(1000000, 2, time.Hour, cache.NewLruPolicy())
+	tier := &mapSpillTier{entries: map[string]cache.Entry{}}
+	c.SetSpillTier(tier)
+
+	for i := 1; i <= 3; i++ {
+		assertNotErr(t, c.Put(strconv.Itoa(i), testItem{size: i}, 100))
+	}
+
+	assertEquals(t, 1, len(tier.entries))
+	assertTrue(t, tier.entries["1"].Item == testItem{size: 1})
+
+	// Fetching a spilled entry moves it back to memory, spilling the LRU entry
+	item, ok := c.Get("1")
+	assertTrue(t, ok)
+	assertEquals(t, 1, item.(testItem).size)
+	assertEquals(t, 1, len(tier.entries))
+	_, ok = tier.entries["2"]
+	assertTrue(t, ok)
+
+	_, ok = c.Get("4")
+	assertFalse(t, ok)
+
+	// Deletes and replacements remove the spilled entry
+	assertTrue(t, c.Delete("2"))
+	assertEquals(t, 0, len(tier.entries))
+
+	stats := c.Stats()
+	assertEquals(t, 1, stats.SpillHitCount)
+	assertEquals(t, 1, stats.SpillMissCount)
+	assertEquals(t, 2, stats.ItemCount)
+	assertEquals(t, 0, stats.SpillItemCount)
+}
+
+func TestExpiredEntriesAreNotPromoted(t *testing.T) {
+	c := cache.NewWithPolicy(1000000, 1, time.Hour, cache.NewLruPolicy())
+	tier := &mapSpillTier{entries: map[string]cache.Entry{}}
+	c.SetSpillTier(tier)
+
+	assertNotErr(t, c.PutWithTTL("1", testItem{}, 100, time.Nanosecond))
+	assertNotErr(t, c.Put("2", testItem{}, 100))
+	assertEquals(t, 1, len(tier.entries))
+	time.Sleep(time.Millisecond)
+
+	_, ok := c.Get("1")
+	assertFalse(t, ok)
+	assertEquals(t, 1, c.Stats().AgeEvictCount)
+}
+
+func TestWalk(t *testing.T) {
+	for name, c := range map[string]cache.Cache{
+		"lru":     cache.New(1000000, time.Hour),
+		"sharded": cache.NewSharded(4, 4000000, 0, time.Hour, cache.NewLruPolicy),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				assertNotErr(t, c.Put(strconv.Itoa(i), testItem{size: i}, 100))
+			}
+			assertNotErr(t, c.PutWithTTL("expired", testItem{}, 100, time.Nanosecond))
+			time.Sleep(time.Millisecond)
+			_, _ = c.Get("3")
+			_, _ = c.Get("3")
+
+			seen := map[string]cache.Entry{}
+			c.Walk(func(e cache.Entry) bool {
+				seen[e.Key] = e
+				return true
+			})
+
+			assertEquals(t, 10, len(seen))
+			assertEquals(t, 2, seen["3"].HitCount)
+			assertTrue(t, !seen["3"].LastAccess.IsZero())
+			assertEquals(t, 0, seen["4"].HitCount)
+			assertTrue(t, seen["4"].LastAccess.IsZero())
+
+			count := 0
+			c.Walk(func(e cache.Entry) bool {
+				count++
+				return count < 3
+			})
+			assertEquals(t, 3, count)
+		})
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	c := cache.New(1000000, time.Hour)
+	assertNotErr(t, c.PutWithTTL("1", testItem{size: 1}, 100, 2*time.Hour))
+	baseSize := c.Stats().ByteSize
+	createTime := c.Entries()[0].CreateTime
+
+	found, err := c.Update("1", func(item interface{}) (interface{}, int, error) {
+		return testItem{size: item.(testItem).size + 1}, 200, nil
+	})
+	assertTrue(t, found)
+	assertNotErr(t, err)
+
+	item, ok := c.Get("1")
+	assertTrue(t, ok)
+	assertEquals(t, 2, item.(testItem).size)
+	assertEquals(t, baseSize+100, c.Stats().ByteSize)
+	assertTrue(t, c.Entries()[0].TTL == 2*time.Hour)
+	assertTrue(t, c.Entries()[0].CreateTime.Equal(createTime))
+
+	// Errors leave the entry untouched
+	found, err = c.Update("1", func(item interface{}) (interface{}, int, error) {
+		return nil, 0, fmt.Errorf("failed")
+	})
+	assertTrue(t, found)
+	assertTrue(t, err != nil)
+	item, _ = c.Get("1")
+	assertEquals(t, 2, item.(testItem).size)
+
+	// As do items too large for the cache
+	found, err = c.Update("1", func(item interface{}) (interface{}, int, error) {
+		return testItem{size: 3}, 2000000, nil
+	})
+	assertTrue(t, found)
+	assertTrue(t, err != nil)
+	item, ok = c.Get("1")
+	assertTrue(t, ok)
+	assertEquals(t, 2, item.(testItem).size)
+
+	found, err = c.Update("2", func(item interface{}) (interface{}, int, error) {
+		t.Error("Unexpected call")
+		return nil, 0, nil
+	})
+	assertFalse(t, found)
+	assertNotErr(t, err)
+}
+
+func TestConcurrentUpdatesAreNotLost(t *testing.T) {
+	c := cache.NewSharded(2, 2000000, 0, 0, cache.NewLruPolicy)
+	assertNotErr(t, c.Put("1", testItem{}, 100))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := c.Update("1", func(item interface{}) (interface{}, int, error) {
+					return testItem{size: item.(testItem).size + 1}, 100, nil
+				})
+				assertNotErr(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	item, _ := c.Get("1")
+	assertEquals(t, 1000, item.(testItem).size)
+}
@@ -0,0 +1,300 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+// EvictionPolicy decides which entry to evict when a cache is full. All methods
+// are called with the cache lock held so implementations need not be thread safe.
+type EvictionPolicy interface {
+	// Added is called when a new entry has been stored under key.
+	Added(key string)
+
+	// Accessed is called when the entry stored under key has been read.
+	Accessed(key string)
+
+	// Removed is called when the entry stored under key leaves the cache.
+	// evicted is true if the entry was evicted because of size, count or age,
+	// false if it was deleted or replaced.
+	Removed(key string, evicted bool)
+
+	// Victim returns the key of the entry that should be evicted next.
+	// Returns false if there are no entries.
+	Victim() (string, bool)
+}
+
+// EvictionPolicyByName returns a constructor for the named eviction policy.
+// Valid names are "lru", "lfu" and "arc".
+func EvictionPolicyByName(name string) (func() EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return NewLruPolicy, nil
+	case "lfu":
+		return NewLfuPolicy, nil
+	case "arc":
+		return NewArcPolicy, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy: %s, valid policies are lru, lfu and arc", name)
+	}
+}
+
+// lruPolicy evicts the least recently used entry.
+type lruPolicy struct {
+	lruList *list.List
+	elems   map[string]*list.Element
+}
+
+func NewLruPolicy() EvictionPolicy {
+	return &lruPolicy{lruList: list.New(), elems: make(map[string]*list.Element)}
+}
+
+func (p *lruPolicy) Added(key string) {
+	p.elems[key] = p.lruList.PushFront(key)
+}
+
+func (p *lruPolicy) Accessed(key string) {
+	if elem, ok := p.elems[key]; ok {
+		p.lruList.MoveToFront(elem)
+	}
+}
+
+func (p *lruPolicy) Removed(key string, _ bool) {
+	if elem, ok := p.elems[key]; ok {
+		p.lruList.Remove(elem)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	elem := p.lruList.Back()
+	if elem == nil {
+		return "", false
+	}
+
+	return elem.Value.(string), true
+}
+
+// lfuPolicy evicts the least frequently used entry. Ties are broken by
+// evicting the least recently used of the candidates.
+type lfuPolicy struct {
+	entries map[string]*lfuEntry
+	heap    lfuHeap
+	seq     uint64
+}
+
+type lfuEntry struct {
+	key   string
+	count int
+	seq   uint64
+	index int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].count < h[j].count
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return e
+}
+
+func NewLfuPolicy() EvictionPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) nextSeq() uint64 {
+	p.seq++
+	return p.seq
+}
+
+func (p *lfuPolicy) Added(key string) {
+	e := &lfuEntry{key: key, count: 1, seq: p.nextSeq()}
+	p.entries[key] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *lfuPolicy) Accessed(key string) {
+	if e, ok := p.entries[key]; ok {
+		e.count++
+		e.seq = p.nextSeq()
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) Removed(key string, _ bool) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+
+	return p.heap[0].key, true
+}
+
+// arcPolicy is an Adaptive Replacement Cache (Megiddo & Modha) policy. Entries
+// seen once are kept in t1 and entries seen more than once in t2. Keys of entries
+// evicted from t1 and t2 are remembered in the ghost lists b1 and b2. Hits in the
+// ghost lists adapt the target size of t1, p. Since entries in t1 are evicted
+// first when t1 is over its target size a flood of entries that are only used
+// once will not push out entries that are used repeatedly.
+//
+// Sizes are counted in number of entries since that is what the policy knows about.
+// The capacity, c, is the largest number of live entries seen so far.
+type arcPolicy struct {
+	lists [arcListCount]*list.List
+	elems map[string]*list.Element
+	p     int
+	c     int
+}
+
+type arcList int
+
+const (
+	arcT1 arcList = iota
+	arcT2
+	arcB1
+	arcB2
+	arcListCount
+)
+
+type arcEntry struct {
+	key  string
+	list arcList
+}
+
+func NewArcPolicy() EvictionPolicy {
+	p := &arcPolicy{elems: make(map[string]*list.Element)}
+	for i := range p.lists {
+		p.lists[i] = list.New()
+	}
+	return p
+}
+
+func (p *arcPolicy) len(l arcList) int {
+	return p.lists[l].Len()
+}
+
+func (p *arcPolicy) liveCount() int {
+	return p.len(arcT1) + p.len(arcT2)
+}
+
+func (p *arcPolicy) unlink(elem *list.Element) {
+	e := elem.Value.(*arcEntry)
+	p.lists[e.list].Remove(elem)
+	delete(p.elems, e.key)
+}
+
+func (p *arcPolicy) pushFront(key string, l arcList) {
+	p.elems[key] = p.lists[l].PushFront(&arcEntry{key: key, list: l})
+}
+
+// trimGhosts keeps each of the ghost lists at most as long as the capacity.
+func (p *arcPolicy) trimGhosts() {
+	for _, l := range []arcList{arcB1, arcB2} {
+		for p.len(l) > p.c {
+			p.unlink(p.lists[l].Back())
+		}
+	}
+}
+
+func (p *arcPolicy) Added(key string) {
+	if elem, ok := p.elems[key]; ok {
+		e := elem.Value.(*arcEntry)
+		switch e.list {
+		case arcB1:
+			// Recently evicted from t1, t1 should be larger
+			p.p = intMin(p.p+intMax(p.len(arcB2)/p.len(arcB1), 1), p.c)
+		case arcB2:
+			// Recently evicted from t2, t2 should be larger
+			p.p = intMax(p.p-intMax(p.len(arcB1)/p.len(arcB2), 1), 0)
+		}
+		p.unlink(elem)
+		p.pushFront(key, arcT2)
+	} else {
+		p.pushFront(key, arcT1)
+	}
+
+	p.c = intMax(p.c, p.liveCount())
+	p.trimGhosts()
+}
+
+func (p *arcPolicy) Accessed(key string) {
+	if elem, ok := p.elems[key]; ok {
+		e := elem.Value.(*arcEntry)
+		if e.list == arcT1 || e.list == arcT2 {
+			p.unlink(elem)
+			p.pushFront(key, arcT2)
+		}
+	}
+}
+
+func (p *arcPolicy) Removed(key string, evicted bool) {
+	elem, ok := p.elems[key]
+	if !ok {
+		return
+	}
+
+	e := elem.Value.(*arcEntry)
+	p.unlink(elem)
+	if evicted {
+		if e.list == arcT1 {
+			p.pushFront(key, arcB1)
+		} else if e.list == arcT2 {
+			p.pushFront(key, arcB2)
+		}
+	}
+
+	p.trimGhosts()
+}
+
+func (p *arcPolicy) Victim() (string, bool) {
+	l := arcT2
+	if p.len(arcT1) > 0 && (p.len(arcT1) > p.p || p.len(arcT2) == 0) {
+		l = arcT1
+	}
+
+	elem := p.lists[l].Back()
+	if elem == nil {
+		return "", false
+	}
+
+	return elem.Value.(*arcEntry).key, true
+}
+
+func intMax(x, y int) int {
+	if x > y {
+		return x
+	}
+
+	return y
+}
@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"time"
+)
+
+// ShardedCache spreads keys over a number of independent LruCaches to reduce
+// lock contention. Each shard gets an equal part of the size and count limits
+// which means that eviction is LRU per shard rather than for the cache as a whole.
+type ShardedCache struct {
+	shards []*LruCache
+	spill  SpillTier
+}
+
+// NewSharded creates a new sharded cache with shardCount shards that together
+// hold at most maxSize bytes and, if maxCount > 0, at most maxCount entries.
+// Each shard gets its own eviction policy created by newPolicy.
+// Note that the minimum size of an LruCache applies to each shard.
+func NewSharded(shardCount, maxSize, maxCount int, maxAge time.Duration, newPolicy func() EvictionPolicy) *ShardedCache {
+	if shardCount < 1 {
+		shardCount = 1
+	}
+
+	shardMaxCount := 0
+	if maxCount > 0 {
+		// Round up to not end up with shards that cannot hold any entries
+		shardMaxCount = (maxCount + shardCount - 1) / shardCount
+	}
+
+	shards := make([]*LruCache, shardCount)
+	for i := range shards {
+		shards[i] = NewWithPolicy(maxSize/shardCount, shardMaxCount, maxAge, newPolicy())
+	}
+
+	return &ShardedCache{shards: shards}
+}
+
+// SetSpillTier sets a spill tier shared by all shards, see LruCache.SetSpillTier.
+func (c *ShardedCache) SetSpillTier(tier SpillTier) {
+	c.spill = tier
+	for _, s := range c.shards {
+		s.SetSpillTier(tier)
+	}
+}
+
+// shard returns the shard responsible for key, FNV-1a is used as hash
+// function. It is implemented inline to avoid allocations.
+func (c *ShardedCache) shard(key string) *LruCache {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+func (c *ShardedCache) Put(key string, item interface{}, byteSize int) error {
+	return c.shard(key).Put(key, item, byteSize)
+}
+
+func (c *ShardedCache) PutWithTTL(key string, item interface{}, byteSize int, ttl time.Duration) error {
+	return c.shard(key).PutWithTTL(key, item, byteSize, ttl)
+}
+
+func (c *ShardedCache) Get(key string) (interface{}, bool) {
+	return c.shard(key).Get(key)
+}
+
+func (c *ShardedCache) Update(key string, fn func(item interface{}) (interface{}, int, error)) (bool, error) {
+	return c.shard(key).Update(key, fn)
+}
+
+func (c *ShardedCache) Delete(key string) bool {
+	return c.shard(key).Delete(key)
+}
+
+func (c *ShardedCache) Restore(entry Entry) (bool, error) {
+	return c.shard(entry.Key).Restore(entry)
+}
+
+func (c *ShardedCache) Entries() []Entry {
+	result := make([]Entry, 0)
+	c.Walk(func(e Entry) bool {
+		result = append(result, e)
+		return true
+	})
+	return result
+}
+
+// Walk visits the entries in memory shard by shard followed by the entries in
+// the shared spill tier, see LruCache.Walk.
+func (c *ShardedCache) Walk(fn func(Entry) bool) {
+	visited := make(map[string]struct{})
+	for _, s := range c.shards {
+		if !s.walkMemory(fn, visited) {
+			return
+		}
+	}
+
+	walkSpill(c.spill, false, c.shards[0].maxAge, fn, visited)
+}
+
+// WalkMeta is like Walk but the items of entries in the spill tier are not
+// read, see SpillTier.WalkMeta.
+func (c *ShardedCache) WalkMeta(fn func(Entry) bool) {
+	visited := make(map[string]struct{})
+	for _, s := range c.shards {
+		if !s.walkMemory(fn, visited) {
+			return
+		}
+	}
+
+	walkSpill(c.spill, true, c.shards[0].maxAge, fn, visited)
+}
+
+func (c *ShardedCache) EvictExpired() int {
+	count := 0
+	for _, s := range c.shards {
+		count += s.evictExpiredInMemory()
+	}
+
+	if c.spill != nil {
+		count += c.spill.EvictExpired(c.shards[0].maxAge)
+	}
+
+	return count
+}
+
+// Stats returns the sum of the statistics of all shards.
+func (c *ShardedCache) Stats() CacheStats {
+	result := CacheStats{TimeToEviction: make([]time.Duration, 0)}
+	for _, s := range c.shards {
+		stat := s.Stats()
+		if room := maxStatHistory - len(result.TimeToEviction); room > 0 {
+			result.TimeToEviction = append(result.TimeToEviction, stat.TimeToEviction[:intMin(room, len(stat.TimeToEviction))]...)
+		}
+		result.ByteSize += stat.ByteSize
+		result.ItemCount += stat.ItemCount
+		result.AgeEvictCount += stat.AgeEvictCount
+		result.SizeEvictCount += stat.SizeEvictCount
+		result.CountEvictCount += stat.CountEvictCount
+		result.ReplaceCount += stat.ReplaceCount
+		result.DeleteCount += stat.DeleteCount
+		result.SpillHitCount += stat.SpillHitCount
+		result.SpillMissCount += stat.SpillMissCount
+
+		// The spill tier is shared between all shards
+		result.SpillByteSize = stat.SpillByteSize
+		result.SpillItemCount = stat.SpillItemCount
+		if stat.StatDuration > result.StatDuration {
+			result.StatDuration = stat.StatDuration
+		}
+	}
+
+	return result
+}
+
+func intMin(x, y int) int {
+	if x < y {
+		return x
+	}
+
+	return y
+}
@@ -0,0 +1,37 @@
+package cache
+
+import (
+	"time"
+)
+
+// SpillTier is secondary, typically slower but larger, storage for entries
+// evicted from memory because of size or count limits.
+// Implementations must be thread safe.
+type SpillTier interface {
+	// Store stores entry, replacing any existing entry with the same key.
+	Store(entry Entry) error
+
+	// Load removes the entry stored under key from the tier and returns it.
+	Load(key string) (Entry, bool)
+
+	// Delete removes the entry stored under key. Returns true if the entry existed.
+	Delete(key string) bool
+
+	// Walk calls fn for each entry, including its item, until fn returns false.
+	// Entries stored or removed during the walk may or may not be visited.
+	Walk(fn func(Entry) bool)
+
+	// WalkMeta is like Walk but the items are not read. Item instead holds
+	// whatever information about the item the tier keeps, or nil.
+	WalkMeta(fn func(Entry) bool)
+
+	// EvictExpired removes all expired entries. Returns the number of removed entries.
+	EvictExpired(maxAge time.Duration) int
+
+	Stats() SpillStats
+}
+
+type SpillStats struct {
+	ByteSize  int
+	ItemCount int
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"time"
+)
+
+// Sweeper periodically evicts expired entries from a cache in the background.
+type Sweeper struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// StartSweeper starts a goroutine that evicts expired entries from c
+// every interval. Call Stop on the returned Sweeper to terminate it.
+func StartSweeper(c Cache, interval time.Duration) *Sweeper {
+	s := &Sweeper{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.EvictExpired()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Stop terminates the sweeper and waits for it to finish.
+func (s *Sweeper) Stop() {
+	close(s.stop)
+	<-s.done
+}
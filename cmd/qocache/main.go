@@ -25,7 +25,7 @@ func main() {
 		logger.Fatalf("Server setup error: %s", err.Error())
 	}
 
-	logger.Printf("Starting qocache, MaxAge: %d, MaxSize: %d, Port: %d, GOMAXPROCS: %d\n", c.Age, c.Size, c.Port, runtime.GOMAXPROCS(0))
+	logger.Printf("Starting qocache, MaxAge: %d, MaxSize: %d, MaxCount: %d, EvictionPolicy: %s, Port: %d, GOMAXPROCS: %d\n", c.Age, c.Size, c.MaxCount, c.EvictionPolicy, c.Port, runtime.GOMAXPROCS(0))
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -37,9 +37,21 @@ func main() {
 		if err := srv.Shutdown(context.Background()); err != nil {
 			logger.Printf("HTTP server Shutdown: %v", err)
 		}
+
+		if count, err := srv.WriteSnapshot(); err != nil {
+			logger.Printf("Error writing snapshot: %v", err)
+		} else if c.SnapshotDir != "" {
+			logger.Printf("Wrote %d datasets to snapshot in %s", count, c.SnapshotDir)
+		}
 		close(idleConnsClosed)
 	}()
 
+	if count, err := srv.RestoreSnapshot(); err != nil {
+		logger.Printf("Error restoring snapshot: %v", err)
+	} else if c.SnapshotDir != "" {
+		logger.Printf("Restored %d datasets from snapshot in %s", count, c.SnapshotDir)
+	}
+
 	if c.HTTPStatusPort != 0 {
 		qhttp.StartHTTPStatusEndpoint(c, logger)
 	}
@@ -21,9 +21,16 @@ import (
 
 type Config struct {
 	Size                 int    `mapstructure:"size"`
+	MaxCount             int    `mapstructure:"max-count"`
+	CacheShards          int    `mapstructure:"cache-shards"`
+	EvictionPolicy       string `mapstructure:"eviction-policy"`
+	SnapshotDir          string `mapstructure:"snapshot-dir"`
+	SpillDir             string `mapstructure:"spill-dir"`
+	SpillSize            int    `mapstructure:"spill-size"`
 	Port                 int    `mapstructure:"port"`
 	HTTPStatusPort       int    `mapstructure:"http-status-port"`
 	Age                  int    `mapstructure:"age"`
+	SweepInterval        int    `mapstructure:"sweep-interval"`
 	StatisticsBufferSize int    `mapstructure:"statistics-buffer-size"`
 	ReadHeaderTimeout    int    `mapstructure:"read-header-timeout"`
 	ReadTimeout          int    `mapstructure:"read-timeout"`
@@ -47,7 +54,11 @@ func init() {
 	addIntParameter("port", "p", "Port to bind to", 8888)
 	addIntParameter("http-status-port", "t", "If set a non-TLS server will be started in addition to qocache which only serves /status, this can be used for health checks and similar", 0)
 	addIntParameter("size", "s", "Max cache size in bytes", 1000000000)
+	addIntParameter("max-count", "m", "Max number of items in cache, 0 = no limit", 0)
+	addIntParameter("cache-shards", "n", "Number of independent cache shards, size and count limits are split evenly between them. 1 = no sharding", 1)
 	addIntParameter("age", "a", "Max age of cached item in seconds, 0 = never expire", 0)
+	addIntParameter("sweep-interval", "e", "Interval in seconds between background evictions of expired items, 0 = only evict expired items when accessed", 60)
+	addIntParameter("spill-size", "z", "Max size in bytes of datasets spilled to disk, see --spill-dir", 10000000000)
 	addIntParameter("statistics-buffer-size", "b", "Number of items to store in statistics ring buffer", 1000)
 	addIntParameter("read-header-timeout", "h", "Timeout in seconds for reading HTTP request headers", 20)
 	addIntParameter("read-timeout", "r", "Timeout in seconds for reading request body", 60)
@@ -55,6 +66,9 @@ func init() {
 	addBoolParameter("http-pprof", "If HTTP pprof endpoint should be enabled or not", false)
 	addBoolParameter("request-log", "If HTTP request logging should be enabled or not", false)
 	addBoolParameter("use-syslog", "If syslog should be used or not, default false => log to stderr (DEPRECATED, use --log-destination instead)", false)
+	addStringParameter("eviction-policy", "Policy used to select items to evict when the cache is full, lru/lfu/arc", "lru")
+	addStringParameter("snapshot-dir", "Directory to write a snapshot of all datasets to on shutdown and restore them from on startup, disabled if not set", "")
+	addStringParameter("spill-dir", "Directory to move datasets evicted from memory because of size or count limits to, disabled if not set", "")
 	addStringParameter("log-destination", "Destination for logs, stderr/stdout/syslog (default stderr)", "stderr")
 	addStringParameter("ca-file", "Path to CA certificate authority file, if passed in it will be used to verify client certificates", "")
 	addStringParameter("cert-file", "Path to file containing certificate and optionally private key for server side TLS", "")
@@ -0,0 +1,257 @@
+// Package datetime implements the datetime column type.
+//
+// QFrame does not have a datetime type, datetimes are instead stored in string
+// columns in a fixed width ISO 8601 format, in UTC with millisecond precision,
+// eg. 2006-01-02T15:04:05.000Z. This makes the lexical order of the strings
+// the same as the chronological order of the datetimes.
+package datetime
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	layout = "2006-01-02T15:04:05.000Z07:00"
+
+	// Type is the name of the datetime type in X-QCache-types
+	Type = "datetime"
+)
+
+// isoLayouts are the layouts accepted when no format is given, tried in order.
+var isoLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Format returns the string representation of t used in datetime columns.
+func Format(t time.Time) string {
+	return t.UTC().Format(layout)
+}
+
+// formatShape is the shape of datetimes formatted by Format, 0 marks digits.
+const formatShape = "0000-00-00T00:00:00.000Z"
+
+// IsFormatted returns true if s has the shape of a datetime as formatted by
+// Format. Only the shape is checked, not that the values are in range.
+func IsFormatted(s string) bool {
+	if len(s) != len(formatShape) {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if formatShape[i] == '0' {
+			if s[i] < '0' || s[i] > '9' {
+				return false
+			}
+		} else if s[i] != formatShape[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ParseISO parses s as an ISO 8601 date or datetime. Datetimes without
+// time zone information are assumed to be in loc.
+func ParseISO(s string, loc *time.Location) (time.Time, error) {
+	for _, l := range isoLayouts {
+		if t, err := time.ParseInLocation(l, s, loc); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid ISO 8601 datetime: %s", s)
+}
+
+// Parser parses datetimes in a specific format.
+type Parser struct {
+	layout    string
+	epochUnit time.Duration
+	loc       *time.Location
+}
+
+// NewParser returns a parser for format, which is either a strftime style format,
+// "epoch" for seconds since the epoch, "epoch_ms" for milliseconds since the epoch
+// or empty for ISO 8601. Datetimes without time zone information are assumed to be
+// in loc.
+func NewParser(format string, loc *time.Location) (Parser, error) {
+	switch format {
+	case "":
+		return Parser{loc: loc}, nil
+	case "epoch":
+		return Parser{epochUnit: time.Second, loc: loc}, nil
+	case "epoch_ms":
+		return Parser{epochUnit: time.Millisecond, loc: loc}, nil
+	}
+
+	l, err := Layout(format)
+	if err != nil {
+		return Parser{}, err
+	}
+
+	return Parser{layout: l, loc: loc}, nil
+}
+
+// Parse parses s according to the format of the parser.
+func (p Parser) Parse(s string) (time.Time, error) {
+	switch {
+	case p.epochUnit != 0:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(x) || math.IsInf(x, 0) {
+			return time.Time{}, fmt.Errorf("invalid epoch time: %s", s)
+		}
+		return time.Unix(0, 0).Add(time.Duration(x * float64(p.epochUnit))), nil
+	case p.layout != "":
+		return time.ParseInLocation(p.layout, s, p.loc)
+	default:
+		return ParseISO(s, p.loc)
+	}
+}
+
+var strftimeDirectives = map[byte]string{
+	'Y': "2006",
+	'y': "06",
+	'm': "01",
+	'd': "02",
+	'e': "_2",
+	'j': "002",
+	'H': "15",
+	'I': "03",
+	'M': "04",
+	'S': "05",
+	'p': "PM",
+	'b': "Jan",
+	'B': "January",
+	'a': "Mon",
+	'A': "Monday",
+	'z': "-0700",
+	'Z': "MST",
+	'F': "2006-01-02",
+	'T': "15:04:05",
+	'%': "%",
+}
+
+// Layout translates a strftime style format into a Go time layout. %f,
+// fractional seconds, is only supported directly after a '.' or ','.
+func Layout(format string) (string, error) {
+	b := strings.Builder{}
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' {
+			if c >= '0' && c <= '9' {
+				return "", fmt.Errorf("digits are not supported outside of directives in datetime format: %s", format)
+			}
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i == len(format) {
+			return "", fmt.Errorf("datetime format ends with a lone %%: %s", format)
+		}
+
+		if format[i] == 'f' {
+			if i < 2 || (format[i-2] != '.' && format[i-2] != ',') {
+				return "", fmt.Errorf("%%f must follow '.' or ',' in datetime format: %s", format)
+			}
+			b.WriteString("000000")
+			continue
+		}
+
+		d, ok := strftimeDirectives[format[i]]
+		if !ok {
+			return "", fmt.Errorf("unsupported directive %%%c in datetime format: %s", format[i], format)
+		}
+		b.WriteString(d)
+	}
+
+	return b.String(), nil
+}
+
+// Truncate returns t, in UTC, truncated to unit which is one of year, month,
+// week (starting on Monday), day, hour, minute or second.
+func Truncate(t time.Time, unit string) (time.Time, error) {
+	t = t.UTC()
+	y, m, d := t.Date()
+	switch unit {
+	case "year":
+		return time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC), nil
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, time.UTC), nil
+	case "week":
+		daysSinceMonday := (int(t.Weekday()) + 6) % 7
+		return time.Date(y, m, d-daysSinceMonday, 0, 0, 0, 0, time.UTC), nil
+	case "day":
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC), nil
+	case "hour":
+		return t.Truncate(time.Hour), nil
+	case "minute":
+		return t.Truncate(time.Minute), nil
+	case "second":
+		return t.Truncate(time.Second), nil
+	default:
+		return t, fmt.Errorf("unknown datetime unit: %s, valid units are year, month, week, day, hour, minute and second", unit)
+	}
+}
+
+// ToDatetime returns a new frame where the values in column have been parsed
+// using p and replaced with datetimes. Null values remain null.
+func ToDatetime(f qf.QFrame, column string, p Parser) qf.QFrame {
+	if f.Err != nil {
+		return f
+	}
+
+	var err error
+	parse := func(s string) *string {
+		t, pErr := p.Parse(s)
+		if pErr != nil {
+			if err == nil {
+				err = fmt.Errorf("could not parse datetime in column %s: %v", column, pErr)
+			}
+			return nil
+		}
+
+		result := Format(t)
+		return &result
+	}
+
+	var fn interface{}
+	switch f.ColumnTypeMap()[column] {
+	case types.String, types.Enum:
+		fn = func(s *string) *string {
+			if s == nil {
+				return nil
+			}
+			return parse(*s)
+		}
+	case types.Int:
+		fn = func(x int) *string { return parse(strconv.Itoa(x)) }
+	case types.Float:
+		fn = func(x float64) *string {
+			if math.IsNaN(x) {
+				return nil
+			}
+			return parse(strconv.FormatFloat(x, 'f', -1, 64))
+		}
+	default:
+		return qf.QFrame{Err: fmt.Errorf("cannot convert column %s to datetime", column)}
+	}
+
+	result := f.Apply(qf.Instruction{Fn: fn, DstCol: column, SrcCol1: column})
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	return result
+}
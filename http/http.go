@@ -10,14 +10,17 @@ import (
 	"github.com/tobgu/qframe/types"
 	"github.com/tobgu/qocache/cache"
 	"github.com/tobgu/qocache/config"
+	"github.com/tobgu/qocache/datetime"
 	"github.com/tobgu/qocache/qlog"
 	"github.com/tobgu/qocache/query"
 	"github.com/tobgu/qocache/statistics"
+	"github.com/tobgu/qocache/storage"
 	qostrings "github.com/tobgu/qocache/strings"
 	"io"
 	"net/http"
 	"net/http/pprof"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -29,9 +32,11 @@ const (
 )
 
 type application struct {
-	cache  cache.Cache
-	stats  *statistics.Statistics
-	logger qlog.Logger
+	cache   cache.Cache
+	stats   *statistics.Statistics
+	logger  qlog.Logger
+	sweeper *cache.Sweeper
+	maxAge  time.Duration
 }
 
 var charsetRegex = regexp.MustCompile("charset=([A-Za-z0-9_-]+)")
@@ -127,6 +132,13 @@ func headersToCsvConfig(headers http.Header) ([]csv.ConfigFunc, error) {
 		return nil, err
 	}
 
+	for col, typ := range typs {
+		if typ == datetime.Type {
+			// Parsed into datetimes after the frame has been read
+			typs[col] = "string"
+		}
+	}
+
 	enumVals, err := readEnumSpec(headers)
 	if err != nil {
 		return nil, err
@@ -152,6 +164,47 @@ func headersToJsonConfig(headers http.Header) ([]newqf.ConfigFunc, error) {
 	return []newqf.ConfigFunc{newqf.Enums(enumVals)}, nil
 }
 
+// headersToDatetimeConfig returns the columns that should be converted to
+// datetimes and the parser to use, given by X-QCache-datetime-format and
+// X-QCache-timezone.
+func headersToDatetimeConfig(headers http.Header) ([]string, datetime.Parser, error) {
+	typs, err := strIfToStrStr(headerToKeyValues(headers, "X-QCache-types"))
+	if err != nil {
+		return nil, datetime.Parser{}, err
+	}
+
+	columns := make([]string, 0)
+	for col, typ := range typs {
+		if typ == datetime.Type {
+			columns = append(columns, col)
+		}
+	}
+
+	loc := time.UTC
+	if tz := headers.Get("X-QCache-timezone"); tz != "" {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			return nil, datetime.Parser{}, fmt.Errorf("invalid X-QCache-timezone: %s", tz)
+		}
+	}
+
+	parser, err := datetime.NewParser(headers.Get("X-QCache-datetime-format"), loc)
+	return columns, parser, err
+}
+
+func headersToTTL(headers http.Header) (time.Duration, error) {
+	ttlStr := headers.Get("X-QCache-ttl")
+	if ttlStr == "" {
+		return 0, nil
+	}
+
+	ttl, err := strconv.Atoi(ttlStr)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid X-QCache-ttl, expected a non negative number of seconds, was: %s", ttlStr)
+	}
+
+	return time.Duration(ttl) * time.Second, nil
+}
+
 func firstErr(errs ...error) error {
 	for _, err := range errs {
 		if err != nil {
@@ -196,58 +249,159 @@ func (a *application) badRequest(w http.ResponseWriter, msg string, params ...in
 	http.Error(w, a.log(msg, params...), http.StatusBadRequest)
 }
 
-func (a *application) newDataset(w http.ResponseWriter, r *http.Request) {
-	statsProbe := statistics.NewStoreProbe(r.Context())
-	defer r.Body.Close()
-	vars := mux.Vars(r)
-	key := vars["key"]
-
+// readDataset reads the dataset in the request body, as specified by the
+// request headers. Any error returned is due to a bad request.
+func readDataset(r *http.Request) (qf.QFrame, error) {
 	var frame qf.QFrame
 	contentType, charset := parseContentType(r.Header.Get("Content-Type"))
 	if charset != "" && charset != "utf-8" {
-		a.badRequest(w, "Unsupported charset: %s", charset)
-		return
+		return frame, fmt.Errorf("unsupported charset: %s", charset)
 	}
 
 	switch contentType {
 	case contentTypeCsv:
 		configFns, err := headersToCsvConfig(r.Header)
 		if err != nil {
-			a.badRequest(w, err.Error())
-			return
+			return frame, err
 		}
 
 		frame = qf.ReadCSV(r.Body, configFns...)
 	case contentTypeJson:
 		configFns, err := headersToJsonConfig(r.Header)
 		if err != nil {
-			a.badRequest(w, err.Error())
-			return
+			return frame, err
 		}
 
 		frame = qf.ReadJSON(r.Body, configFns...)
 	default:
-		a.badRequest(w, "Unknown content type: %s", contentType)
-		return
+		return frame, fmt.Errorf("unknown content type: %s", contentType)
 	}
 
 	if frame.Err != nil {
-		a.badRequest(w, "Could not decode data: %v", frame.Err)
+		return frame, fmt.Errorf("could not decode data: %v", frame.Err)
+	}
+
+	datetimeColumns, parser, err := headersToDatetimeConfig(r.Header)
+	if err != nil {
+		return frame, err
+	}
+
+	for _, col := range datetimeColumns {
+		if frame = datetime.ToDatetime(frame, col, parser); frame.Err != nil {
+			return frame, frame.Err
+		}
+	}
+
+	frame, _, err = addStandInColumns(frame, r.Header)
+	return frame, firstErr(err, frame.Err)
+}
+
+func (a *application) newDataset(w http.ResponseWriter, r *http.Request) {
+	statsProbe := statistics.NewStoreProbe(r.Context())
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	ttl, err := headersToTTL(r.Header)
+	if err != nil {
+		a.badRequest(w, err.Error())
 		return
 	}
 
-	frame, _, err := addStandInColumns(frame, r.Header)
-	if err = firstErr(err, frame.Err); err != nil {
+	frame, err := readDataset(r)
+	if err != nil {
+		a.badRequest(w, err.Error())
+		return
+	}
+
+	enumVals, err := readEnumSpec(r.Header)
+	if err != nil {
 		a.badRequest(w, err.Error())
 		return
 	}
 
-	err = a.cache.Put(key, frame, frame.ByteSize())
+	dataset := storage.NewDataset(frame, enumVals)
+	if dataset.Frame.Err != nil {
+		a.badRequest(w, dataset.Frame.Err.Error())
+		return
+	}
+
+	err = a.cache.PutWithTTL(key, dataset, dataset.ByteSize(), ttl)
 	a.logError("Put new dataset in cache", err)
 	w.WriteHeader(http.StatusCreated)
 	statsProbe.Success(frame.Len())
 }
 
+// appendDataset appends the rows in the request body to an existing dataset.
+func (a *application) appendDataset(w http.ResponseWriter, r *http.Request) {
+	a.mergeDataset(w, r, "append", func(cached storage.Dataset, frame qf.QFrame, enums map[string][]string) storage.Dataset {
+		return storage.Concat(cached, frame, enums)
+	})
+}
+
+// upsertDataset replaces the rows in an existing dataset that have the same values
+// in the key columns as a row in the request body with that row, other rows in the
+// request body are appended.
+func (a *application) upsertDataset(w http.ResponseWriter, r *http.Request) {
+	keyColumns := make([]string, 0)
+	for _, col := range strings.Split(r.Header.Get("X-QCache-key-columns"), ",") {
+		if col = trim(col); col != "" {
+			keyColumns = append(keyColumns, col)
+		}
+	}
+
+	if len(keyColumns) == 0 {
+		a.badRequest(w, "X-QCache-key-columns required for upsert")
+		return
+	}
+
+	a.mergeDataset(w, r, "upsert", func(cached storage.Dataset, frame qf.QFrame, enums map[string][]string) storage.Dataset {
+		return storage.Upsert(cached, frame, keyColumns, enums)
+	})
+}
+
+// mergeDataset replaces an existing dataset with the result of merging it with the
+// dataset in the request body using mergeFn.
+func (a *application) mergeDataset(w http.ResponseWriter, r *http.Request, operation string,
+	mergeFn func(cached storage.Dataset, frame qf.QFrame, enums map[string][]string) storage.Dataset) {
+	statsProbe := statistics.NewStoreProbe(r.Context())
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	key := vars["key"]
+
+	frame, err := readDataset(r)
+	if err != nil {
+		a.badRequest(w, err.Error())
+		return
+	}
+
+	enumVals, err := readEnumSpec(r.Header)
+	if err != nil {
+		a.badRequest(w, err.Error())
+		return
+	}
+
+	found, err := a.cache.Update(key, func(item interface{}) (interface{}, int, error) {
+		dataset := mergeFn(item.(storage.Dataset), frame, enumVals)
+		return dataset, dataset.ByteSize(), dataset.Frame.Err
+	})
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		_, err := w.Write([]byte(fmt.Sprintf("Dataset '%s' not found", key)))
+		a.logError("Merge dataset write not found", err)
+		return
+	}
+
+	if err != nil {
+		a.badRequest(w, "Could not %s data: %v", operation, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	statsProbe.Success(frame.Len())
+}
+
 func addStandInColumns(frame qf.QFrame, headers http.Header) (qf.QFrame, bool, error) {
 	standIns, err := headerToKeyValues(headers, "X-QCache-stand-in-columns")
 	if err != nil {
@@ -312,13 +466,21 @@ func (a *application) queryDataset(w http.ResponseWriter, r *http.Request, qFn f
 		statsProbe.Missing()
 		return
 	}
-	frame := item.(qf.QFrame)
+	dataset := item.(storage.Dataset)
+	frame := dataset.Frame
 	qstring, err := qFn(r)
 	if err != nil {
 		a.badRequest(w, "Error reading query: %s", err.Error())
 		return
 	}
 
+	storeAs := r.Header.Get("X-QCache-store-as")
+	ttl, err := headersToTTL(r.Header)
+	if err != nil && storeAs != "" {
+		a.badRequest(w, err.Error())
+		return
+	}
+
 	frame, columnAdded, err := addStandInColumns(frame, r.Header)
 	if err != nil {
 		a.badRequest(w, "Error adding standin columns: %s", err.Error())
@@ -327,13 +489,17 @@ func (a *application) queryDataset(w http.ResponseWriter, r *http.Request, qFn f
 
 	if columnAdded {
 		// Need to replace existing frame in cache since the new one contains
-		// additional columns.
-		err := a.cache.Put(key, frame, frame.ByteSize())
+		// additional columns. Update keeps the TTL and age of the dataset.
+		_, err := a.cache.Update(key, func(item interface{}) (interface{}, int, error) {
+			d := item.(storage.Dataset)
+			f, _, err := addStandInColumns(d.Frame, r.Header)
+			return d.WithFrame(f), f.ByteSize(), err
+		})
 		a.logError("Column added put dataset in cache", err)
 	}
 
 	if qstring != "" {
-		result := query.Query(frame, qstring)
+		result := query.Query(frame, qstring, a.dataset)
 		if result.Err != nil {
 			a.badRequest(w, "Error executing query: %s", result.Err.Error())
 			return
@@ -342,6 +508,23 @@ func (a *application) queryDataset(w http.ResponseWriter, r *http.Request, qFn f
 		w.Header().Set("X-QCache-unsliced-length", fmt.Sprintf("%d", result.UnslicedLen))
 	}
 
+	if storeAs != "" {
+		// Materialize the query result as a new dataset, enum columns from the
+		// queried dataset keep their enum definitions.
+		result := storage.NewDataset(frame, dataset.Enums)
+		if err := firstErr(result.Frame.Err, a.cache.PutWithTTL(storeAs, result, result.ByteSize(), ttl)); err != nil {
+			a.badRequest(w, "Error storing query result: %s", err.Error())
+			return
+		}
+
+		if r.Header.Get("Accept") == "" {
+			// Only store the result, don't return it
+			w.WriteHeader(http.StatusCreated)
+			statsProbe.Success()
+			return
+		}
+	}
+
 	// This is a bit simplistic since we assume that only one content type
 	// is listed and not a prioritized . Good enough for now.
 	accept := r.Header.Get("Accept")
@@ -365,6 +548,177 @@ func (a *application) queryDataset(w http.ResponseWriter, r *http.Request, qFn f
 	statsProbe.Success()
 }
 
+// dataset returns the dataset stored under key, used to resolve references
+// to other datasets in queries.
+func (a *application) dataset(key string) (qf.QFrame, bool) {
+	item, ok := a.cache.Get(key)
+	if !ok {
+		return qf.QFrame{}, false
+	}
+
+	dataset, ok := item.(storage.Dataset)
+	return dataset.Frame, ok
+}
+
+// deleteRows removes the rows matching the where clause in the request body
+// from an existing dataset.
+func (a *application) deleteRows(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	key := vars["key"]
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		a.badRequest(w, "Error reading query: %s", err.Error())
+		return
+	}
+
+	deletedCount := 0
+	found, err := a.cache.Update(key, func(item interface{}) (interface{}, int, error) {
+		dataset := item.(storage.Dataset)
+		result := query.Delete(dataset.Frame, string(b), a.dataset)
+		deletedCount = result.DeletedCount
+		return dataset.WithFrame(result.Qframe), result.Qframe.ByteSize(), result.Err
+	})
+
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		_, err := w.Write([]byte(fmt.Sprintf("Dataset '%s' not found", key)))
+		a.logError("Delete rows write not found", err)
+		return
+	}
+
+	if err != nil {
+		a.badRequest(w, "Error deleting rows: %s", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", formatContentType(contentTypeJson))
+	err = json.NewEncoder(w).Encode(map[string]int{"deleted_count": deletedCount})
+	a.logError("Encoding delete rows response", err)
+}
+
+func (a *application) deleteDataset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	if !a.cache.Delete(key) {
+		w.WriteHeader(http.StatusNotFound)
+		_, err := w.Write([]byte(fmt.Sprintf("Dataset '%s' not found", key)))
+		a.logError("Delete dataset write not found", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+type datasetInfo struct {
+	Key            string     `json:"key"`
+	ByteSize       int        `json:"byte_size"`
+	RowCount       int        `json:"row_count"`
+	Columns        []string   `json:"columns"`
+	CreateTime     time.Time  `json:"create_time"`
+	LastAccessTime *time.Time `json:"last_access_time"`
+	TTLRemaining   *float64   `json:"ttl_remaining"`
+	HitCount       int        `json:"hit_count"`
+}
+
+func newDatasetInfo(e cache.Entry, maxAge time.Duration) datasetInfo {
+	info := datasetInfo{Key: e.Key, ByteSize: e.ByteSize, CreateTime: e.CreateTime, HitCount: e.HitCount, Columns: []string{}}
+	switch item := e.Item.(type) {
+	case storage.Dataset:
+		info.RowCount = item.Frame.Len()
+		info.Columns = item.Frame.ColumnNames()
+	case storage.FrameInfo:
+		info.RowCount = item.RowCount
+		info.Columns = item.Columns
+	}
+
+	if !e.LastAccess.IsZero() {
+		info.LastAccessTime = &e.LastAccess
+	}
+
+	if expiresIn, ok := e.ExpiresIn(maxAge); ok {
+		seconds := expiresIn.Seconds()
+		info.TTLRemaining = &seconds
+	}
+
+	return info
+}
+
+func formIntValue(r *http.Request, name string, defaultValue int) (int, error) {
+	s := r.Form.Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid %s, expected a non negative integer, was: %s", name, s)
+	}
+
+	return i, nil
+}
+
+// listDatasets lists the datasets in memory and in the spill tier, ordered by key.
+// The list can be filtered on key prefix and paginated using offset and limit.
+func (a *application) listDatasets(w http.ResponseWriter, r *http.Request) {
+	accept := r.Header.Get("Accept")
+	if accept == "" || accept == "*/*" {
+		accept = contentTypeJson
+	}
+
+	if accept != contentTypeJson {
+		a.badRequest(w, "Unknown accept type: %s, dataset list only available in JSON format", accept)
+		return
+	}
+
+	err := r.ParseForm()
+	a.logError("Form parse dataset list", err)
+	prefix := r.Form.Get("prefix")
+	offset, err := formIntValue(r, "offset", 0)
+	if err != nil {
+		a.badRequest(w, err.Error())
+		return
+	}
+
+	limit, err := formIntValue(r, "limit", 0)
+	if err != nil {
+		a.badRequest(w, err.Error())
+		return
+	}
+
+	entries := make([]cache.Entry, 0)
+	a.cache.WalkMeta(func(e cache.Entry) bool {
+		if strings.HasPrefix(e.Key, prefix) {
+			entries = append(entries, e)
+		}
+		return true
+	})
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	w.Header().Set("X-QCache-unsliced-length", fmt.Sprintf("%d", len(entries)))
+	entries = entries[intMin(offset, len(entries)):]
+	if limit > 0 {
+		entries = entries[:intMin(limit, len(entries))]
+	}
+
+	result := make([]datasetInfo, len(entries))
+	for i, e := range entries {
+		result[i] = newDatasetInfo(e, a.maxAge)
+	}
+
+	w.Header().Set("Content-Type", formatContentType(accept))
+	err = json.NewEncoder(w).Encode(result)
+	a.logError("Encoding dataset list", err)
+}
+
+func intMin(x, y int) int {
+	if x < y {
+		return x
+	}
+
+	return y
+}
+
 func (a *application) statistics(w http.ResponseWriter, r *http.Request) {
 	accept := r.Header.Get("Accept")
 	if accept == "" || accept == "*/*" {
@@ -400,10 +754,57 @@ func attachProfiler(router *mux.Router) {
 	router.Handle("/debug/pprof/block", pprof.Handler("block"))
 }
 
+// close releases resources held by the application, eg. background goroutines.
+func (a *application) close() {
+	if a.sweeper != nil {
+		a.sweeper.Stop()
+	}
+}
+
+// Application returns a router serving the qocache API. No background goroutines
+// are started, expired items are only evicted when accessed, see NewServer.
 func Application(conf config.Config, logger qlog.Logger) (*mux.Router, error) {
-	c := cache.New(conf.Size, time.Duration(conf.Age)*time.Second)
+	_, r, err := newApplication(conf, logger)
+	return r, err
+}
+
+func newCache(conf config.Config) (cache.Cache, error) {
+	newPolicy, err := cache.EvictionPolicyByName(conf.EvictionPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	var c interface {
+		cache.Cache
+		SetSpillTier(cache.SpillTier)
+	}
+
+	maxAge := time.Duration(conf.Age) * time.Second
+	if conf.CacheShards > 1 {
+		c = cache.NewSharded(conf.CacheShards, conf.Size, conf.MaxCount, maxAge, newPolicy)
+	} else {
+		c = cache.NewWithPolicy(conf.Size, conf.MaxCount, maxAge, newPolicy())
+	}
+
+	if conf.SpillDir != "" {
+		tier, err := storage.NewDiskTier(conf.SpillDir, conf.SpillSize)
+		if err != nil {
+			return nil, err
+		}
+		c.SetSpillTier(tier)
+	}
+
+	return c, nil
+}
+
+func newApplication(conf config.Config, logger qlog.Logger) (*application, *mux.Router, error) {
+	c, err := newCache(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	s := statistics.New(c, conf.StatisticsBufferSize)
-	app := &application{cache: c, stats: s, logger: logger}
+	app := &application{cache: c, stats: s, logger: logger, maxAge: time.Duration(conf.Age) * time.Second}
 	r := mux.NewRouter()
 
 	middleWares := make([]middleware, 0)
@@ -417,7 +818,7 @@ func Application(conf config.Config, logger qlog.Logger) (*mux.Router, error) {
 	if conf.BasicAuth != "" {
 		user, password, err := parseBasicAuth(conf.BasicAuth)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		middleWares = append(middleWares, withBasicAuth(app.logger, user, password))
 	}
@@ -430,7 +831,12 @@ func Application(conf config.Config, logger qlog.Logger) (*mux.Router, error) {
 	for _, root := range []string{"/qcache", "/qocache"} {
 		r.HandleFunc(root+"/dataset/{key}", mw(app.newDataset)).Methods("POST")
 		r.HandleFunc(root+"/dataset/{key}/q", mw(app.queryDatasetPost)).Methods("POST")
+		r.HandleFunc(root+"/dataset/{key}/append", mw(app.appendDataset)).Methods("POST")
+		r.HandleFunc(root+"/dataset/{key}/upsert", mw(app.upsertDataset)).Methods("POST")
+		r.HandleFunc(root+"/dataset/{key}/delete", mw(app.deleteRows)).Methods("POST")
 		r.HandleFunc(root+"/dataset/{key}", mw(app.queryDatasetGet)).Methods("GET")
+		r.HandleFunc(root+"/dataset/{key}", mw(app.deleteDataset)).Methods("DELETE")
+		r.HandleFunc(root+"/datasets", mw(app.listDatasets)).Methods("GET")
 		r.HandleFunc(root+"/statistics", mw(app.statistics)).Methods("GET")
 		r.HandleFunc(root+"/status", mw(app.status)).Methods("GET")
 	}
@@ -439,7 +845,7 @@ func Application(conf config.Config, logger qlog.Logger) (*mux.Router, error) {
 		attachProfiler(r)
 	}
 
-	return r, nil
+	return app, r, nil
 }
 
 func parseBasicAuth(auth string) (string, string, error) {
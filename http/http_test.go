@@ -9,18 +9,23 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/pierrec/lz4"
 	"github.com/stretchr/testify/assert"
+	"github.com/tobgu/qframe/types"
 	"github.com/tobgu/qocache/config"
 	h "github.com/tobgu/qocache/http"
 	"github.com/tobgu/qocache/qlog"
+	"github.com/tobgu/qocache/query"
 	"github.com/tobgu/qocache/statistics"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func assertNotErr(t testing.TB, err error) {
@@ -144,6 +149,17 @@ func (c *testCache) insertCsvWithExpectedCode(key string, headers map[string]str
 	}
 }
 
+func (c *testCache) mergeCsv(key, operation string, headers map[string]string, input interface{}) *httptest.ResponseRecorder {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers["Content-Type"] = "text/csv"
+
+	b := new(bytes.Buffer)
+	assertNotErr(c.t, gocsv.Marshal(input, b))
+	return c.insertDataset(key+"/"+operation, headers, b)
+}
+
 func (c *testCache) insertJson(key string, headers map[string]string, input interface{}) {
 	if headers == nil {
 		headers = make(map[string]string)
@@ -226,6 +242,68 @@ func (c *testCache) queryDataset(key string, headers map[string]string, q, metho
 	return rr
 }
 
+func (c *testCache) deleteDataset(key string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("/qocache/dataset/%s", key), nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	c.app.ServeHTTP(rr, req)
+	return rr
+}
+
+type datasetInfo struct {
+	Key            string
+	ByteSize       int        `json:"byte_size"`
+	RowCount       int        `json:"row_count"`
+	Columns        []string   `json:"columns"`
+	CreateTime     time.Time  `json:"create_time"`
+	LastAccessTime *time.Time `json:"last_access_time"`
+	TTLRemaining   *float64   `json:"ttl_remaining"`
+	HitCount       int        `json:"hit_count"`
+}
+
+func (c *testCache) listDatasets(params string) ([]datasetInfo, *httptest.ResponseRecorder) {
+	req, err := http.NewRequest("GET", "/qocache/datasets?"+params, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	c.app.ServeHTTP(rr, req)
+
+	result := make([]datasetInfo, 0)
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			c.t.Fatalf("Failed to unmarshal JSON dataset list: %v", err)
+		}
+	}
+
+	return result, rr
+}
+
+func (c *testCache) deleteRows(key, q string) (int, *httptest.ResponseRecorder) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("/qocache/dataset/%s/delete", key), strings.NewReader(q))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	c.app.ServeHTTP(rr, req)
+
+	result := struct {
+		DeletedCount int `json:"deleted_count"`
+	}{}
+	if rr.Code == http.StatusOK {
+		if err := json.Unmarshal(rr.Body.Bytes(), &result); err != nil {
+			c.t.Fatalf("Failed to unmarshal JSON delete response: %v", err)
+		}
+	}
+
+	return result.DeletedCount, rr
+}
+
 func (c *testCache) statistics() statistics.StatisticsData {
 	req, err := http.NewRequest("GET", "/qocache/statistics", nil)
 	if err != nil {
@@ -543,6 +621,22 @@ func TestStandinColumns(t *testing.T) {
 	}
 }
 
+func TestStandinColumnsInQueryKeepTTL(t *testing.T) {
+	cache, err := newTestCacheWithConfig(t, config.Config{Size: 1000000000, StatisticsBufferSize: 1000, Age: 60})
+	assertNotErr(t, err)
+	cache.insertCsv("FOO", map[string]string{"X-QCache-ttl": "3600"}, []TestData{{S: "Foo"}})
+	datasets, _ := cache.listDatasets("")
+	createTime := datasets[0].CreateTime
+
+	output := make([]map[string]interface{}, 0)
+	cache.queryJson("FOO", map[string]string{"X-QCache-stand-in-columns": "X=1"}, "{}", "GET", &output)
+	assertEqual(t, 1.0, output[0]["X"])
+
+	datasets, _ = cache.listDatasets("")
+	assertTrue(t, datasets[0].CreateTime.Equal(createTime))
+	assertTrue(t, *datasets[0].TTLRemaining > 60)
+}
+
 func enumTypes(enumVals map[string][]string) map[string]string {
 	result := make(map[string]string)
 	for k := range enumVals {
@@ -966,10 +1060,938 @@ bbb,2
 	assertEqual(t, expected, output)
 }
 
+func TestDeleteDataset(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "Foo"}})
+
+	rr := cache.deleteDataset("FOO")
+	assertEqual(t, http.StatusOK, rr.Code)
+
+	rr = cache.queryJson("FOO", map[string]string{}, "{}", "GET", nil)
+	assertEqual(t, http.StatusNotFound, rr.Code)
+
+	rr = cache.deleteDataset("FOO")
+	assertEqual(t, http.StatusNotFound, rr.Code)
+	assertEqual(t, "Dataset 'FOO' not found", rr.Body.String())
+
+	stats := cache.statistics()
+	assertEqual(t, 0, stats.DatasetCount)
+	assertEqual(t, 1, stats.DeleteCount)
+}
+
+func TestInsertWithTTL(t *testing.T) {
+	cache := newTestCache(t)
+	input := []TestData{{S: "Foo"}}
+	cases := []struct {
+		ttl          string
+		expectedCode int
+	}{
+		{ttl: "", expectedCode: http.StatusCreated},
+		{ttl: "0", expectedCode: http.StatusCreated},
+		{ttl: "3600", expectedCode: http.StatusCreated},
+		{ttl: "-1", expectedCode: http.StatusBadRequest},
+		{ttl: "1.5", expectedCode: http.StatusBadRequest},
+		{ttl: "abc", expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("Insert with TTL '%s'", tc.ttl), func(t *testing.T) {
+			cache.insertCsvWithExpectedCode("FOO", map[string]string{"X-QCache-ttl": tc.ttl}, input, tc.expectedCode)
+		})
+	}
+}
+
+func TestShardedCache(t *testing.T) {
+	cache, err := newTestCacheWithConfig(t, config.Config{Size: 1000000000, StatisticsBufferSize: 1000, CacheShards: 4})
+	assertNotErr(t, err)
+
+	for i := 0; i < 10; i++ {
+		cache.insertCsv(fmt.Sprintf("FOO%d", i), nil, []TestData{{S: "Foo", I: i}})
+	}
+
+	for i := 0; i < 10; i++ {
+		output := make([]TestData, 0)
+		rr := cache.queryJson(fmt.Sprintf("FOO%d", i), nil, "{}", "GET", &output)
+		assertEqual(t, http.StatusOK, rr.Code)
+		assertEqual(t, []TestData{{S: "Foo", I: i}}, output)
+	}
+
+	stats := cache.statistics()
+	assertEqual(t, 10, stats.DatasetCount)
+	assertEqual(t, 10, stats.HitCount)
+}
+
+func TestEvictionPolicy(t *testing.T) {
+	for _, policy := range []string{"lru", "lfu", "arc"} {
+		t.Run(policy, func(t *testing.T) {
+			cache, err := newTestCacheWithConfig(t, config.Config{Size: 1000000000, StatisticsBufferSize: 1000, EvictionPolicy: policy})
+			assertNotErr(t, err)
+
+			cache.insertCsv("FOO", nil, []TestData{{S: "Foo"}})
+			cache.queryJson("FOO", nil, "{}", "GET", &[]TestData{})
+			cache.queryJson("FOO", nil, "{}", "GET", &[]TestData{})
+			cache.queryJson("BAR", nil, "{}", "GET", nil)
+
+			stats := cache.statistics()
+			assertEqual(t, 2, stats.HitCount)
+			assertEqual(t, 1, stats.MissCount)
+			assertEqual(t, 2.0/3.0, stats.HitRate)
+		})
+	}
+
+	_, err := newTestCacheWithConfig(t, config.Config{Size: 1000000000, StatisticsBufferSize: 1000, EvictionPolicy: "foo"})
+	assertTrue(t, err != nil)
+}
+
+func TestListDatasets(t *testing.T) {
+	cache, err := newTestCacheWithConfig(t, config.Config{Size: 1000000000, StatisticsBufferSize: 1000, Age: 60})
+	assertNotErr(t, err)
+	cache.insertCsv("FOO1", nil, []TestData{{S: "Foo"}, {S: "Bar"}})
+	cache.insertCsv("FOO2", map[string]string{"X-QCache-ttl": "3600"}, []TestData{{S: "Foo"}})
+	cache.insertCsv("BAR", nil, []TestData{{S: "Foo"}})
+	cache.queryJson("FOO1", nil, "{}", "GET", &[]TestData{})
+	cache.queryJson("FOO1", nil, "{}", "GET", &[]TestData{})
+
+	datasets, rr := cache.listDatasets("")
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, "3", rr.Header().Get("X-QCache-unsliced-length"))
+	assertEqual(t, 3, len(datasets))
+	assertEqual(t, "BAR", datasets[0].Key)
+
+	foo1 := datasets[1]
+	assertEqual(t, "FOO1", foo1.Key)
+	assertEqual(t, 2, foo1.RowCount)
+	assertEqual(t, []string{"S", "I", "F", "B", "I2", "I3"}, foo1.Columns)
+	assertEqual(t, 2, foo1.HitCount)
+	assertTrue(t, foo1.ByteSize > 0)
+	assertTrue(t, time.Since(foo1.CreateTime) < time.Minute)
+	assertTrue(t, foo1.LastAccessTime != nil && !foo1.LastAccessTime.Before(foo1.CreateTime))
+	assertTrue(t, *foo1.TTLRemaining > 0 && *foo1.TTLRemaining <= 60)
+
+	foo2 := datasets[2]
+	assertTrue(t, foo2.LastAccessTime == nil)
+	assertTrue(t, *foo2.TTLRemaining > 60 && *foo2.TTLRemaining <= 3600)
+
+	datasets, rr = cache.listDatasets("prefix=FOO&offset=1&limit=5")
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, "2", rr.Header().Get("X-QCache-unsliced-length"))
+	assertEqual(t, 1, len(datasets))
+	assertEqual(t, "FOO2", datasets[0].Key)
+
+	datasets, _ = cache.listDatasets("limit=1")
+	assertEqual(t, 1, len(datasets))
+	assertEqual(t, "BAR", datasets[0].Key)
+
+	datasets, _ = cache.listDatasets("offset=10")
+	assertEqual(t, 0, len(datasets))
+
+	_, rr = cache.listDatasets("limit=-1")
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestAppendDataset(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", map[string]string{"X-QCache-ttl": "3600"}, []TestData{{S: "Foo", I: 1}})
+
+	rr := cache.mergeCsv("FOO", "append", nil, []TestData{{S: "Bar", I: 2}, {S: "Baz", I: 3}})
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]TestData, 0)
+	cache.queryJson("FOO", nil, "{}", "GET", &output)
+	assertEqual(t, []TestData{{S: "Foo", I: 1}, {S: "Bar", I: 2}, {S: "Baz", I: 3}}, output)
+
+	datasets, _ := cache.listDatasets("")
+	assertEqual(t, 3, datasets[0].RowCount)
+	assertTrue(t, *datasets[0].TTLRemaining > 3000)
+
+	rr = cache.mergeCsv("BAR", "append", nil, []TestData{{S: "Bar"}})
+	assertEqual(t, http.StatusNotFound, rr.Code)
+
+	// Schema must match
+	headers := map[string]string{"X-QCache-types": "I=string"}
+	rr = cache.mergeCsv("FOO", "append", headers, []TestData{{S: "Bar", I: 2}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	headers = map[string]string{"X-QCache-stand-in-columns": "X=1"}
+	rr = cache.mergeCsv("FOO", "append", headers, []TestData{{S: "Bar", I: 2}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	stats := cache.statistics()
+	assertEqual(t, 2, len(stats.StoreRowCounts))
+	assertEqual(t, 2, stats.StoreRowCounts[1])
+}
+
+func TestAppendDatasetWithEnums(t *testing.T) {
+	cache := newTestCache(t)
+	headers := func(values ...string) map[string]string {
+		enumSpecJson, err := json.Marshal(map[string][]string{"S": values})
+		assertNotErr(t, err)
+		return map[string]string{"X-QCache-types": "S=enum", "X-QCache-enum-specs": string(enumSpecJson)}
+	}
+	cache.insertCsv("FOO", headers("low", "medium", "high"), []TestData{{S: "high"}, {S: "low"}})
+
+	// Values defined in the cached data are accepted without the enum specification
+	rr := cache.mergeCsv("FOO", "append", map[string]string{"X-QCache-types": "S=enum"}, []TestData{{S: "medium"}})
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	// Values not defined in the cached data require the enum specification
+	rr = cache.mergeCsv("FOO", "append", map[string]string{"X-QCache-types": "S=enum"}, []TestData{{S: "extreme"}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	rr = cache.mergeCsv("FOO", "append", headers("low", "medium", "high", "extreme"), []TestData{{S: "extreme"}})
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]TestData, 0)
+	cache.queryJson("FOO", nil, `{"order_by": ["S"], "select": ["S"]}`, "GET", &output)
+	assertEqual(t, []TestData{{S: "low"}, {S: "medium"}, {S: "high"}, {S: "extreme"}}, output)
+
+	// Stored query results keep the enum values defined in the queried dataset
+	rr = cache.queryDataset("FOO", map[string]string{"X-QCache-store-as": "BAR"}, `{"where": ["=", "S", "'high'"]}`, "GET")
+	assertEqual(t, http.StatusCreated, rr.Code)
+	rr = cache.mergeCsv("BAR", "append", map[string]string{"X-QCache-types": "S=enum"}, []TestData{{S: "extreme"}, {S: "low"}})
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output = make([]TestData, 0)
+	cache.queryJson("BAR", nil, `{"order_by": ["S"], "select": ["S"]}`, "GET", &output)
+	assertEqual(t, []TestData{{S: "low"}, {S: "high"}, {S: "extreme"}}, output)
+}
+
+func TestUpsertDataset(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "Foo", I: 1, F: 1.5}, {S: "Foo", I: 2, F: 2.5}, {S: "Bar", I: 1, F: 3.5}})
+
+	headers := map[string]string{"X-QCache-key-columns": "S, I"}
+	rr := cache.mergeCsv("FOO", "upsert", headers, []TestData{{S: "Foo", I: 2, F: 4.5}, {S: "Bar", I: 2, F: 5.5}})
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]TestData, 0)
+	cache.queryJson("FOO", nil, `{"order_by": ["S", "I"]}`, "GET", &output)
+	assertEqual(t, []TestData{{S: "Bar", I: 1, F: 3.5}, {S: "Bar", I: 2, F: 5.5}, {S: "Foo", I: 1, F: 1.5}, {S: "Foo", I: 2, F: 4.5}}, output)
+
+	rr = cache.mergeCsv("FOO", "upsert", nil, []TestData{{S: "Foo", I: 2}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	rr = cache.mergeCsv("FOO", "upsert", map[string]string{"X-QCache-key-columns": "X"}, []TestData{{S: "Foo", I: 2, F: 0.5}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	rr = cache.mergeCsv("FOO", "upsert", map[string]string{"X-QCache-key-columns": "S"}, []TestData{{S: "Foo", I: 2, F: 0.5}, {S: "Foo", I: 3, F: 0.5}})
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+
+	rr = cache.mergeCsv("BAR", "upsert", headers, []TestData{{S: "Foo", I: 2}})
+	assertEqual(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDeleteRows(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv"},
+		strings.NewReader("S,I,F\nFoo,1,1.5\nBar,2,\nBaz,3,3.5\nQux,4,4.5\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	count, rr := cache.deleteRows("FOO", `{"where": ["<", "F", 2]}`)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, 1, count)
+
+	count, rr = cache.deleteRows("FOO", `{"where": ["|", ["=", "S", "'Baz'"], ["=", "S", "'Nope'"]]}`)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, 1, count)
+
+	// Rows with null values that do not match are kept
+	output := make([]TestData, 0)
+	cache.queryJson("FOO", nil, `{"select": ["S", "I"], "order_by": ["I"]}`, "GET", &output)
+	assertEqual(t, []TestData{{S: "Bar", I: 2}, {S: "Qux", I: 4}}, output)
+
+	count, rr = cache.deleteRows("FOO", `{"where": ["=", "S", "'Nope'"]}`)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, 0, count)
+
+	for _, q := range []string{`{}`, `{"where": ["<", "X", 2]}`, `not json`} {
+		_, rr = cache.deleteRows("FOO", q)
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+
+	_, rr = cache.deleteRows("BAR", `{"where": ["<", "F", 2]}`)
+	assertEqual(t, http.StatusNotFound, rr.Code)
+
+	datasets, _ := cache.listDatasets("")
+	assertEqual(t, 2, datasets[0].RowCount)
+}
+
+func TestStoreQueryResult(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "Foo", I: 1}, {S: "Foo", I: 2}, {S: "Bar", I: 3}})
+	q := `{"select": ["S", ["sum", "I"]], "group_by": ["S"], "order_by": ["S"]}`
+
+	// Return the result in addition to storing it
+	output := make([]TestData, 0)
+	headers := map[string]string{"X-QCache-store-as": "FOO_SUM", "X-QCache-ttl": "3600"}
+	rr := cache.queryJson("FOO", headers, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	expected := []TestData{{S: "Bar", I: 3}, {S: "Foo", I: 3}}
+	assertEqual(t, expected, output)
+
+	output = make([]TestData, 0)
+	cache.queryJson("FOO_SUM", nil, "{}", "GET", &output)
+	assertEqual(t, expected, output)
+
+	datasets, _ := cache.listDatasets("prefix=FOO_SUM")
+	assertEqual(t, 1, len(datasets))
+	assertTrue(t, *datasets[0].TTLRemaining > 3000)
+
+	// Only store the result
+	rr = cache.queryDataset("FOO", map[string]string{"X-QCache-store-as": "FOO_SUM2"}, q, "GET")
+	assertEqual(t, http.StatusCreated, rr.Code)
+	assertEqual(t, 0, rr.Body.Len())
+	output = make([]TestData, 0)
+	cache.queryJson("FOO_SUM2", nil, "{}", "GET", &output)
+	assertEqual(t, expected, output)
+
+	rr = cache.queryDataset("FOO", map[string]string{"X-QCache-store-as": "FOO_SUM3", "X-QCache-ttl": "-1"}, q, "GET")
+	assertEqual(t, http.StatusBadRequest, rr.Code)
+	rr = cache.queryDataset("FOO_SUM3", nil, "{}", "GET")
+	assertEqual(t, http.StatusNotFound, rr.Code)
+}
+
+func TestJoin(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FACTS", nil, []TestData{{S: "a", I: 1}, {S: "b", I: 2}, {S: "c", I: 3}})
+	cache.insertCsv("REF", nil, []TestData{{S: "A", I: 1, I2: 10}, {S: "B", I: 2, I2: 20}})
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"join": {"dataset": "REF", "on": ["I"], "prefix": "R_"}, "select": ["S", "I", "R_I2"], "order_by": ["I"]}`
+	rr := cache.queryJson("FACTS", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"S": "a", "I": 1.0, "R_I2": 10.0}, {"S": "b", "I": 2.0, "R_I2": 20.0}}, output)
+
+	// Colliding columns are prefixed, the joined columns can be used in the rest of the query
+	output = make([]map[string]interface{}, 0)
+	q = `{"join": {"dataset": "REF", "on": [["I", "I"]], "how": "left"}, "select": ["S", "REF_S"], "where": ["!=", "S", "'b'"], "order_by": ["S"]}`
+	rr = cache.queryJson("FACTS", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"S": "a", "REF_S": "A"}, {"S": "c", "REF_S": nil}}, output)
+
+	for _, q := range []string{
+		`{"join": {"dataset": "NOPE", "on": ["I"]}}`,
+		`{"join": {"dataset": "REF", "on": ["X"]}}`,
+		`{"join": {"dataset": "REF", "on": ["I"], "how": "outer"}}`,
+		`{"join": {"dataset": "REF", "on": [1]}}`,
+	} {
+		rr = cache.queryDataset("FACTS", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestInFilterWithSubQuery(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "a", I: 1, I2: 10}, {S: "b", I: 2, I2: 20}, {S: "c", I: 3, I2: 30}})
+	cache.insertCsv("BAR", nil, []TestData{{S: "c", I: 2}, {S: "x", I: 1}})
+
+	cases := []struct {
+		q        string
+		expected []TestData
+	}{
+		{q: `{"where": ["in", "I", {"select": ["I"], "where": [">", "I2", 15]}], "select": ["S"]}`,
+			expected: []TestData{{S: "b"}, {S: "c"}}},
+		{q: `{"where": ["in", "S", {"select": ["S"], "dataset": "BAR"}], "select": ["S"]}`,
+			expected: []TestData{{S: "c"}}},
+		{q: `{"where": ["!", ["in", "I", {"select": ["I"], "where": ["=", "S", "'x'"], "dataset": "BAR"}]], "select": ["S"]}`,
+			expected: []TestData{{S: "b"}, {S: "c"}}},
+		{q: `{"where": ["in", "I", {"select": ["I"], "where": ["=", "S", "'y'"]}], "select": ["S"]}`,
+			expected: []TestData{}},
+		// Without dataset the subquery is executed on the result of from
+		{q: `{"from": {"where": ["<", "I", 3]}, "where": ["in", "I", {"select": ["I"], "where": [">", "I2", 5]}], "select": ["S"]}`,
+			expected: []TestData{{S: "a"}, {S: "b"}}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.q, func(t *testing.T) {
+			output := make([]TestData, 0)
+			rr := cache.queryJson("FOO", nil, tc.q, "POST", &output)
+			assertEqual(t, http.StatusOK, rr.Code)
+			assertEqual(t, tc.expected, output)
+		})
+	}
+
+	for _, q := range []string{
+		`{"where": ["in", "I", {"select": ["I", "S"]}]}`,
+		`{"where": ["in", "I", {"select": ["I"], "dataset": "NOPE"}]}`,
+		`{"where": ["in", "I", {"select": ["X"]}]}`,
+	} {
+		rr := cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+
+	// Subqueries can be used when deleting rows as well
+	count, rr := cache.deleteRows("FOO", `{"where": ["in", "S", {"select": ["S"], "dataset": "BAR"}]}`)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, 1, count)
+}
+
+func TestHaving(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "a", I: 1}, {S: "a", I: 2}, {S: "b", I: 5}, {S: "c", I: 1}})
+
+	output := make([]TestData, 0)
+	q := `{"select": ["S", ["sum", "I"]], "group_by": ["S"], "having": [">", "I", 2], "order_by": ["S"]}`
+	rr := cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []TestData{{S: "a", I: 3}, {S: "b", I: 5}}, output)
+
+	// Filtering on both the rows before aggregation and the aggregated result
+	output = make([]TestData, 0)
+	q = `{"select": ["S", ["sum", "I"]], "where": ["!=", "I", 2], "group_by": ["S"], "having": ["&", [">", "I", 0], ["!=", "S", "'b'"]], "order_by": ["S"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []TestData{{S: "a", I: 1}, {S: "c", I: 1}}, output)
+
+	// Expressions and subqueries, subqueries without dataset query the aggregated rows
+	for _, having := range []string{
+		`[">", ["cast", "I", "float"], 2.5]`,
+		`["in", "I", {"select": ["I"], "where": [">", "I", 2]}]`,
+	} {
+		output = make([]TestData, 0)
+		q = `{"select": ["S", ["sum", "I"]], "group_by": ["S"], "having": ` + having + `, "order_by": ["S"]}`
+		rr = cache.queryJson("FOO", nil, q, "POST", &output)
+		assertEqual(t, http.StatusOK, rr.Code)
+		assertEqual(t, []TestData{{S: "a", I: 3}, {S: "b", I: 5}}, output)
+	}
+
+	for _, q := range []string{
+		`{"having": [">", "I", 2]}`,
+		`{"select": ["S", ["sum", "I"]], "group_by": ["S"], "having": [">", "X", 2]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestAggregationAliases(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{{S: "a", I: 1}, {S: "a", I: 2}, {S: "b", I: 5}})
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["S", ["sum", "I", "total"], ["max", "I", "biggest"], ["count"], ["count", null, "n"], ["count", "I", "n_i"]], "group_by": ["S"],
+           "having": [">", "total", 4], "order_by": ["S"]}`
+	rr := cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"S": "b", "total": 5.0, "biggest": 5.0, "count": 1.0, "n": 1.0, "n_i": 1.0}}, output)
+
+	// Row count when grouping by the first column
+	output = make([]map[string]interface{}, 0)
+	rr = cache.queryJson("FOO", nil, `{"select": ["S", ["count"]], "group_by": ["S"], "order_by": ["S"]}`, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"S": "a", "count": 2.0}, {"S": "b", "count": 1.0}}, output)
+
+	// Aggregation over all rows
+	output = make([]map[string]interface{}, 0)
+	rr = cache.queryJson("FOO", nil, `{"select": [["count"], ["min", "I", "smallest"]]}`, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"count": 3.0, "smallest": 1.0}}, output)
+
+	for _, q := range []string{
+		`{"select": [["sum", "I", "I"], ["max", "I", "I"]]}`,
+		`{"select": [["sum", "I", 1]]}`,
+		`{"select": [["sum"]]}`,
+		`{"select": [["sum", "I", "a", "b"]]}`,
+		`{"select": [["count", "X"]]}`,
+		`{"select": [["count", "X", "n"]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{
+		{S: "b", I: 20, I2: 1}, {S: "a", I: 2, I2: 2}, {S: "a", I: 1, I2: 2}, {S: "b", I: 10, I2: 2}, {S: "a", I: 3, I2: 1}})
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["S", "I",
+                      {"window": "row_number", "as": "rn", "partition_by": ["S"], "order_by": ["I"]},
+                      {"window": "rank", "as": "rank", "order_by": ["I2"]},
+                      {"window": "dense_rank", "as": "dense_rank", "order_by": ["-I2"]},
+                      {"window": "sum", "column": "I", "as": "running_total", "partition_by": ["S"], "order_by": ["I"]},
+                      {"window": "sum", "column": "I", "as": "total", "partition_by": ["S"]},
+                      {"window": "mean", "column": "I", "as": "moving_avg", "partition_by": ["S"], "order_by": ["I"], "frame": [-1, 0]},
+                      {"window": "lag", "column": "I", "as": "prev", "partition_by": ["S"], "order_by": ["I"]},
+                      {"window": "lead", "column": "S", "as": "next", "order_by": ["S", "I"], "offset": 2}],
+           "order_by": ["S", "I"]}`
+	rr := cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "a", "I": 1.0, "rn": 1.0, "rank": 3.0, "dense_rank": 1.0, "running_total": 1.0, "total": 6.0, "moving_avg": 1.0, "prev": nil, "next": "a"},
+		{"S": "a", "I": 2.0, "rn": 2.0, "rank": 3.0, "dense_rank": 1.0, "running_total": 3.0, "total": 6.0, "moving_avg": 1.5, "prev": 1.0, "next": "b"},
+		{"S": "a", "I": 3.0, "rn": 3.0, "rank": 1.0, "dense_rank": 2.0, "running_total": 6.0, "total": 6.0, "moving_avg": 2.5, "prev": 2.0, "next": "b"},
+		{"S": "b", "I": 10.0, "rn": 1.0, "rank": 3.0, "dense_rank": 1.0, "running_total": 10.0, "total": 30.0, "moving_avg": 10.0, "prev": nil, "next": nil},
+		{"S": "b", "I": 20.0, "rn": 2.0, "rank": 1.0, "dense_rank": 2.0, "running_total": 30.0, "total": 30.0, "moving_avg": 15.0, "prev": 10.0, "next": nil},
+	}, output)
+
+	// Window functions are evaluated after where
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["I", {"window": "count", "as": "n"}, {"window": "max", "column": "I", "as": "max_so_far", "order_by": ["I"]}],
+          "where": ["<", "I", 10], "order_by": ["-I"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"I": 3.0, "n": 3.0, "max_so_far": 3.0},
+		{"I": 2.0, "n": 3.0, "max_so_far": 2.0},
+		{"I": 1.0, "n": 3.0, "max_so_far": 1.0},
+	}, output)
+
+	for _, q := range []string{
+		`{"select": [{"window": "median", "column": "I", "as": "m"}]}`,
+		`{"select": [{"window": "sum", "column": "I"}]}`,
+		`{"select": [{"window": "sum", "as": "x"}]}`,
+		`{"select": [{"window": "sum", "column": "S", "as": "x"}]}`,
+		`{"select": [{"window": "rank", "as": "x"}]}`,
+		`{"select": [{"window": "lag", "column": "I", "as": "x", "frame": [-1, 0]}]}`,
+		`{"select": [{"window": "sum", "column": "I", "as": "x", "frame": [1, 0]}]}`,
+		`{"select": [{"window": "sum", "column": "I", "as": "x", "frame": [1]}]}`,
+		`{"select": [{"window": "sum", "column": "I", "as": "x", "partition_by": ["X"]}]}`,
+		`{"select": [{"window": "sum", "column": "I", "as": "x", "partition_by": "S"}]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCustomAggregations(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{
+		{S: "a", I: 1, F: 1.5}, {S: "a", I: 2, F: 1.5}, {S: "a", I: 4, F: 2.5}, {S: "a", I: 10, F: 3.5}, {S: "b", I: 5, F: 4.5}})
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["S", ["median", "I"], ["median", "F", "median_f"], ["percentile", "I", "p75", 75],
+                      ["percentile", "F", null, 0], ["count_distinct", "F", "distinct_f"], ["count_distinct", "S", "distinct_s"],
+                      ["max", "I", "max_i"]],
+           "group_by": ["S"], "order_by": ["S"]}`
+	rr := cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "a", "I": 3.0, "median_f": 2.0, "p75": 5.5, "F": 1.5, "distinct_f": 3.0, "distinct_s": 1.0, "max_i": 10.0},
+		{"S": "b", "I": 5.0, "median_f": 4.5, "p75": 5.0, "F": 4.5, "distinct_f": 1.0, "distinct_s": 1.0, "max_i": 5.0},
+	}, output)
+
+	registerTestAggregation.Do(func() {
+		query.RegisterAggregation("string_agg", func(colType types.DataType, args []interface{}) (interface{}, error) {
+			if colType != types.String {
+				return nil, fmt.Errorf("only string columns supported")
+			}
+			return func(xs []*string) *string {
+				parts := make([]string, 0, len(xs))
+				for _, x := range xs {
+					parts = append(parts, *x)
+				}
+				result := strings.Join(parts, args[0].(string))
+				return &result
+			}, nil
+		})
+	})
+
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": [["string_agg", "S", "all", "-"], ["count_distinct", "S", "n"]]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"all": "a-a-a-a-b", "n": 2.0}}, output)
+
+	for _, q := range []string{
+		`{"select": [["median", "S"]]}`,
+		`{"select": [["median", "I", "m", 1]]}`,
+		`{"select": [["percentile", "I", "p"]]}`,
+		`{"select": [["percentile", "I", "p", 101]]}`,
+		`{"select": [["percentile", "I", "p", "high"]]}`,
+		`{"select": [["count_distinct", "X"]]}`,
+		`{"select": [["string_agg", "I", "x", "-"]]}`,
+		`{"select": [["sum", "I", "x", 1]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+var registerTestAggregation sync.Once
+
+func TestDatetime(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv", "X-QCache-types": "T=datetime"},
+		strings.NewReader("S,T\na,2024-03-01T10:30:00+01:00\nb,2024-02-28\nc,2024-03-15 23:59:59.5\nd,\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]map[string]interface{}, 0)
+	rr = cache.queryJson("FOO", nil, `{"order_by": ["T"], "where": ["!=", "S", "'d'"]}`, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "b", "T": "2024-02-28T00:00:00.000Z"},
+		{"S": "a", "T": "2024-03-01T09:30:00.000Z"},
+		{"S": "c", "T": "2024-03-15T23:59:59.500Z"},
+	}, output)
+
+	// Comparisons with ISO literals
+	for q, expected := range map[string][]string{
+		`{"where": [">", "T", "'2024-02-28'"]}`:                {"a", "c"},
+		`{"where": ["=", "T", "'2024-02-28T00:00:00Z'"]}`:      {"b"},
+		`{"where": ["<", "T", "'2024-03-01T11:00:00+01:00'"]}`: {"b", "a"},
+	} {
+		output = make([]map[string]interface{}, 0)
+		rr = cache.queryJson("FOO", nil, strings.TrimSuffix(q, "}")+`, "select": ["S"], "order_by": ["T"]}`, "POST", &output)
+		assertEqual(t, http.StatusOK, rr.Code)
+		result := make([]string, 0)
+		for _, row := range output {
+			result = append(result, row["S"].(string))
+		}
+		assertEqual(t, expected, result)
+	}
+
+	// Date functions
+	output = make([]map[string]interface{}, 0)
+	q := `{"select": ["S", ["=", "y", ["year", "T"]], ["=", "m", ["month", "T"]], ["=", "h", ["hour", "T"]],
+                      ["=", "month_start", ["date_trunc", "T", "'month'"]], ["=", "d", ["date_format", "T", "'%d/%m %H:%M'"]]],
+           "order_by": ["S"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "a", "y": 2024.0, "m": 3.0, "h": 9.0, "month_start": "2024-03-01T00:00:00.000Z", "d": "01/03 09:30"},
+		{"S": "b", "y": 2024.0, "m": 2.0, "h": 0.0, "month_start": "2024-02-01T00:00:00.000Z", "d": "28/02 00:00"},
+		{"S": "c", "y": 2024.0, "m": 3.0, "h": 23.0, "month_start": "2024-03-01T00:00:00.000Z", "d": "15/03 23:59"},
+		{"S": "d", "y": nil, "m": nil, "h": nil, "month_start": nil, "d": nil},
+	}, output)
+
+	// Group by the result of a function
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": [["=", "month", ["date_trunc", "T", "'month'"]], ["count"]], "group_by": ["month"],
+          "where": ["!=", "S", "'d'"], "order_by": ["month"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"month": "2024-02-01T00:00:00.000Z", "count": 1.0},
+		{"month": "2024-03-01T00:00:00.000Z", "count": 2.0},
+	}, output)
+
+	for _, q := range []string{
+		`{"where": ["<", "T", "'yesterday'"]}`,
+		`{"select": [["=", "x", ["date_trunc", "T", "'decade'"]]]}`,
+		`{"select": [["=", "x", ["date_format", "T", "'%Q'"]]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestDatetimeFormatAndTimezone(t *testing.T) {
+	cache := newTestCache(t)
+	for _, tc := range []struct {
+		headers map[string]string
+		input   string
+	}{
+		{headers: map[string]string{"X-QCache-datetime-format": "%d/%m/%Y %H:%M", "X-QCache-timezone": "Europe/Stockholm"},
+			input: "T\n01/07/2024 12:00\n"},
+		{headers: map[string]string{"X-QCache-datetime-format": "epoch"}, input: "T\n1719828000\n"},
+		{headers: map[string]string{"X-QCache-datetime-format": "epoch_ms"}, input: "T\n1719828000000\n"},
+		{headers: map[string]string{"X-QCache-timezone": "America/New_York"}, input: "T\n2024-07-01T06:00:00\n"},
+	} {
+		tc.headers["Content-Type"] = "text/csv"
+		tc.headers["X-QCache-types"] = "T=datetime"
+		rr := cache.insertDataset("FOO", tc.headers, strings.NewReader(tc.input))
+		assertEqual(t, http.StatusCreated, rr.Code)
+
+		output := make([]map[string]interface{}, 0)
+		rr = cache.queryJson("FOO", nil, `{}`, "POST", &output)
+		assertEqual(t, http.StatusOK, rr.Code)
+		assertEqual(t, []map[string]interface{}{{"T": "2024-07-01T10:00:00.000Z"}}, output)
+	}
+
+	for _, headers := range []map[string]string{
+		{"X-QCache-timezone": "Nowhere/Special"},
+		{"X-QCache-datetime-format": "%Y-%Q"},
+		{"X-QCache-datetime-format": "%Y-%m-%d"},
+	} {
+		headers["Content-Type"] = "text/csv"
+		headers["X-QCache-types"] = "T=datetime"
+		rr := cache.insertDataset("FOO", headers, strings.NewReader("T\n01/07/2024 12:00\n"))
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCaseExpression(t *testing.T) {
+	cache := newTestCache(t)
+	cache.insertCsv("FOO", nil, []TestData{
+		{S: "a", I: 1, F: 0.5}, {S: "b", I: 5, F: 1.5}, {S: "c", I: 10, F: 2.5}, {S: "d", I: 50, F: 3.5}})
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["S",
+                      ["=", "band", ["case", [["<", "I", 5], "'low'"], [["<", "I", 20], "'medium'"], "'high'"]],
+                      ["=", "scaled", ["case", [["&", [">", "I", 1], ["<", "F", 3]], ["*", "F", 10]], "I"]],
+                      ["=", "maybe", ["case", [["=", "S", "'b'"], "I"]]],
+                      ["=", "nested", ["case", [[">", "I", 5], ["case", [[">", "I", 20], "'huge'"], "'big'"]], "S"]]],
+           "order_by": ["S"]}`
+	rr := cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "a", "band": "low", "scaled": 1.0, "maybe": nil, "nested": "a"},
+		{"S": "b", "band": "medium", "scaled": 15.0, "maybe": 5.0, "nested": "b"},
+		{"S": "c", "band": "medium", "scaled": 25.0, "maybe": nil, "nested": "big"},
+		{"S": "d", "band": "high", "scaled": 50.0, "maybe": nil, "nested": "huge"},
+	}, output)
+
+	// Group by case expression
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": [["=", "band", ["case", [["<", "I", 10], "'low'"], "'high'"]], ["sum", "I"]], "group_by": ["band"], "order_by": ["band"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"band": "high", "I": 60.0}, {"band": "low", "I": 6.0}}, output)
+
+	// Conditions with expressions and subqueries on other datasets
+	cache.insertCsv("BAR", nil, []TestData{{S: "b"}, {S: "d"}})
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["S",
+                      ["=", "listed", ["case", [["in", "S", {"dataset": "BAR", "select": ["S"]}], "'yes'"], "'no'"]],
+                      ["=", "big", ["case", [[">", ["*", "F", 2], 5], "'yes'"], "'no'"]]],
+           "where": ["=", ["case", [["in", "S", {"dataset": "BAR", "select": ["S"]}], 1], 0], 1],
+           "order_by": ["S"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"S": "b", "listed": "yes", "big": "no"},
+		{"S": "d", "listed": "yes", "big": "yes"},
+	}, output)
+
+	for _, q := range []string{
+		`{"select": [["=", "x", ["case"]]]}`,
+		`{"select": [["=", "x", ["case", "'a'"]]]}`,
+		`{"select": [["=", "x", ["case", "'a'", [["<", "I", 5], "'b'"]]]]}`,
+		`{"select": [["=", "x", ["case", [["<", "I", 5], "'b'"], "'c'", "'d'"]]]}`,
+		`{"select": [["=", "x", ["case", [["<", "I", 5], "'b'"], 1]]]}`,
+		`{"select": [["=", "x", ["case", [["<", "X", 5], "'b'"]]]]}`,
+		`{"select": [["=", "x", ["case", [["<", "I", 5], "X"]]]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestStringFunctions(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv"},
+		strings.NewReader("S,I\n  Hello World  ,1\nfoo-bar-baz,2\n,3\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["I",
+                      ["=", "trimmed", ["trim", "S"]],
+                      ["=", "sub", ["substr", ["trim", "S"], 1, 5]],
+                      ["=", "tail", ["substr", "S", 5]],
+                      ["=", "len", ["length", "S"]],
+                      ["=", "replaced", ["replace", "S", "'-'", "'_'"]],
+                      ["=", "part", ["split_part", "S", "'-'", 2]],
+                      ["=", "last", ["split_part", "S", "'-'", -1]],
+                      ["=", "upper", ["upper", ["concat", "S", "'#'", "I"]]],
+                      ["=", "len_plus", ["+", ["length", ["trim", "S"]], 1.5]]],
+           "order_by": ["I"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"I": 1.0, "trimmed": "Hello World", "sub": "Hello", "tail": "llo World  ", "len": 15.0, "replaced": "  Hello World  ",
+			"part": "", "last": "  Hello World  ", "upper": "  HELLO WORLD  #1", "len_plus": 12.5},
+		{"I": 2.0, "trimmed": "foo-bar-baz", "sub": "foo-b", "tail": "bar-baz", "len": 11.0, "replaced": "foo_bar_baz",
+			"part": "bar", "last": "baz", "upper": "FOO-BAR-BAZ#2", "len_plus": 12.5},
+		{"I": 3.0, "trimmed": nil, "sub": nil, "tail": nil, "len": nil, "replaced": nil,
+			"part": nil, "last": nil, "upper": "#3", "len_plus": nil},
+	}, output)
+
+	// Filter and group by derived columns
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["I", ["=", "first", ["split_part", "S", "'-'", 1]]], "where": ["=", "first", "'foo'"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"I": 2.0, "first": "foo"}}, output)
+
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": [["=", "has_dash", ["length", ["split_part", "S", "'-'", 2]]], ["count"]], "group_by": ["has_dash"],
+          "where": ["!", ["isnull", "S"]], "order_by": ["has_dash"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"has_dash": 0.0, "count": 1.0}, {"has_dash": 3.0, "count": 1.0}}, output)
+
+	// Derived columns depending on other derived columns
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["I", ["=", "a", ["trim", "S"]], ["=", "b", ["upper", "a"]]], "where": ["=", "b", "'HELLO WORLD'"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"I": 1.0, "a": "Hello World", "b": "HELLO WORLD"}}, output)
+
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": [["=", "trimmed", ["trim", "S"]], ["=", "len", ["length", "trimmed"]], ["count"]], "group_by": ["len"],
+          "order_by": ["len"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"len": 11.0, "count": 2.0}, {"len": nil, "count": 1.0}}, output)
+
+	for _, q := range []string{
+		`{"select": [["=", "x", ["substr", "S"]]]}`,
+		`{"select": [["=", "x", ["substr", "S", 1.5]]]}`,
+		`{"select": [["=", "x", ["substr", "S", 1, -1]]]}`,
+		`{"select": [["=", "x", ["substr", "I", 1]]]}`,
+		`{"select": [["=", "x", ["split_part", "S", "'-'", 0]]]}`,
+		`{"select": [["=", "x", ["replace", "S", "'a'"]]]}`,
+		`{"select": [["=", "x", ["+", ["length", "S"], 1, 2]]]}`,
+		`{"select": [["=", "x", ["length", "X"]]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestMathAndNullFunctions(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv"},
+		strings.NewReader("S,I,F\na,-15,2.345\n,4,\nc,100,-1.5\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["I",
+                      ["=", "abs", ["abs", "I"]],
+                      ["=", "round", ["round", "F"]],
+                      ["=", "round2", ["round", "F", 2]],
+                      ["=", "round_i", ["round", "I", -1]],
+                      ["=", "floor", ["floor", "F"]],
+                      ["=", "ceil", ["ceil", "F"]],
+                      ["=", "sqrt", ["sqrt", ["abs", "I"]]],
+                      ["=", "log", ["log", 100, 10]],
+                      ["=", "pow", ["pow", "I", 2]],
+                      ["=", "f_or_i", ["coalesce", "F", "I"]],
+                      ["=", "s_or_x", ["coalesce", "S", "'x'"]],
+                      ["=", "nullif", ["nullif", "I", 4]],
+                      ["=", "is_null", ["is_null", "F"]]],
+           "order_by": ["I"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"I": -15.0, "abs": 15.0, "round": 2.0, "round2": 2.35, "round_i": -20.0, "floor": 2.0, "ceil": 3.0, "sqrt": math.Sqrt(15),
+			"log": 2.0, "pow": 225.0, "f_or_i": 2.345, "s_or_x": "a", "nullif": -15.0, "is_null": false},
+		{"I": 4.0, "abs": 4.0, "round": nil, "round2": nil, "round_i": 0.0, "floor": nil, "ceil": nil, "sqrt": 2.0,
+			"log": 2.0, "pow": 16.0, "f_or_i": 4.0, "s_or_x": "x", "nullif": nil, "is_null": true},
+		{"I": 100.0, "abs": 100.0, "round": -2.0, "round2": -1.5, "round_i": 100.0, "floor": -2.0, "ceil": -1.0, "sqrt": 10.0,
+			"log": 2.0, "pow": 10000.0, "f_or_i": -1.5, "s_or_x": "c", "nullif": 100.0, "is_null": false},
+	}, output)
+
+	for _, q := range []string{
+		`{"select": [["=", "x", ["round", "S"]]]}`,
+		`{"select": [["=", "x", ["round", "F", 1.5]]]}`,
+		`{"select": [["=", "x", ["sqrt", "F", 2]]]}`,
+		`{"select": [["=", "x", ["pow", "F"]]]}`,
+		`{"select": [["=", "x", ["coalesce", "S", "I"]]]}`,
+		`{"select": [["=", "x", ["nullif", "S", 1]]]}`,
+		`{"select": [["=", "x", ["is_null"]]]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestCast(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv"},
+		strings.NewReader("S,I,F,B\n1,0,2.7,true\n 2 ,3,-1.5,false\nx,5,,true\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	output := make([]map[string]interface{}, 0)
+	q := `{"select": ["I",
+                      ["=", "f_int", ["cast", "F", "int"]],
+                      ["=", "i_str", ["cast", "I", "string"]],
+                      ["=", "i_bool", ["cast", "I", "bool"]],
+                      ["=", "b_int", ["cast", "B", "int"]],
+                      ["=", "s_int", ["try_cast", "S", "int"]],
+                      ["=", "s_float", ["try_cast", "S", "'float'"]],
+                      ["=", "s_bool", ["try_cast", "S", "bool"]],
+                      ["=", "b_enum", ["cast", "B", "enum"]],
+                      ["=", "expr", ["cast", ["+", "I", "I"], "float"]]],
+           "order_by": ["I"]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{
+		{"I": 0.0, "f_int": 2.0, "i_str": "0", "i_bool": false, "b_int": 1.0, "s_int": 1.0, "s_float": 1.0,
+			"s_bool": "true", "b_enum": "true", "expr": 0.0},
+		{"I": 3.0, "f_int": -1.0, "i_str": "3", "i_bool": true, "b_int": 0.0, "s_int": 2.0, "s_float": 2.0,
+			"s_bool": nil, "b_enum": "false", "expr": 6.0},
+		{"I": 5.0, "f_int": nil, "i_str": "5", "i_bool": true, "b_int": 1.0, "s_int": nil, "s_float": nil,
+			"s_bool": nil, "b_enum": "true", "expr": 10.0},
+	}, output)
+
+	// Expressions in filters
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["I"], "where": ["&", [">", ["try_cast", "S", "int"], 1], ["=", ["cast", "I", "string"], "'3'"]]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"I": 3.0}}, output)
+
+	output = make([]map[string]interface{}, 0)
+	q = `{"select": ["I"], "where": ["<", "F", ["try_cast", "S", "float"]]}`
+	rr = cache.queryJson("FOO", nil, q, "POST", &output)
+	assertEqual(t, http.StatusOK, rr.Code)
+	assertEqual(t, []map[string]interface{}{{"I": 3.0}}, output)
+
+	for _, q := range []string{
+		`{"select": [["=", "x", ["cast", "S", "int"]]]}`,
+		`{"select": [["=", "x", ["cast", "S", "bool"]]]}`,
+		`{"select": [["=", "x", ["cast", "S", "date"]]]}`,
+		`{"select": [["=", "x", ["cast", "S"]]]}`,
+		`{"where": ["=", ["cast", "S", "int"], 1]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestOrderByNullsAndExpressions(t *testing.T) {
+	cache := newTestCache(t)
+	rr := cache.insertDataset("FOO", map[string]string{"Content-Type": "text/csv"},
+		strings.NewReader("S,F\nb,1.5\n,-3.0\nc,\na,2.0\n"))
+	assertEqual(t, http.StatusCreated, rr.Code)
+
+	for _, tc := range []struct {
+		orderBy  string
+		expected []interface{}
+	}{
+		// Backward compatible defaults, nulls are ordered as large values
+		{orderBy: `["F"]`, expected: []interface{}{-3.0, 1.5, 2.0, nil}},
+		{orderBy: `["-F"]`, expected: []interface{}{nil, 2.0, 1.5, -3.0}},
+		{orderBy: `[{"col": "F"}]`, expected: []interface{}{-3.0, 1.5, 2.0, nil}},
+		{orderBy: `[{"col": "F", "desc": true}]`, expected: []interface{}{nil, 2.0, 1.5, -3.0}},
+		{orderBy: `[{"col": "F", "nulls": "first"}]`, expected: []interface{}{nil, -3.0, 1.5, 2.0}},
+		{orderBy: `[{"col": "F", "nulls": "last"}]`, expected: []interface{}{-3.0, 1.5, 2.0, nil}},
+		{orderBy: `[{"col": "F", "desc": true, "nulls": "first"}]`, expected: []interface{}{nil, 2.0, 1.5, -3.0}},
+		{orderBy: `[{"col": "F", "desc": true, "nulls": "last"}]`, expected: []interface{}{2.0, 1.5, -3.0, nil}},
+		{orderBy: `[{"col": ["abs", "F"], "desc": true, "nulls": "last"}]`, expected: []interface{}{-3.0, 2.0, 1.5, nil}},
+		{orderBy: `[{"col": ["coalesce", "S", "'z'"]}]`, expected: []interface{}{2.0, 1.5, nil, -3.0}},
+		{orderBy: `[{"col": "S", "nulls": "first"}, "-F"]`, expected: []interface{}{-3.0, 2.0, 1.5, nil}},
+	} {
+		t.Run(tc.orderBy, func(t *testing.T) {
+			output := make([]map[string]interface{}, 0)
+			rr := cache.queryJson("FOO", nil, fmt.Sprintf(`{"select": ["F"], "order_by": %s}`, tc.orderBy), "POST", &output)
+			assertEqual(t, http.StatusOK, rr.Code)
+
+			result := make([]interface{}, len(output))
+			for i, row := range output {
+				result[i] = row["F"]
+			}
+			assertEqual(t, tc.expected, result)
+		})
+	}
+
+	for _, q := range []string{
+		`{"order_by": [{"col": "F", "nulls": "middle"}]}`,
+		`{"order_by": [{"col": 1}]}`,
+		`{"order_by": [{"col": ["foo", "F"]}]}`,
+		`{"order_by": [{"col": "X"}]}`,
+	} {
+		rr = cache.queryDataset("FOO", map[string]string{"Accept": "application/json"}, q, "POST")
+		assertEqual(t, http.StatusBadRequest, rr.Code)
+	}
+}
+
 /* TODO
 - Fix integer JSON parsing for generic maps in tests, right now they become floats
 - Null stand ins?
-- In filter with sub query
 - Logging, should be pluggable, add request logging
 - README
 - Python integration tests
@@ -1,11 +1,14 @@
 package http
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"fmt"
+	"github.com/tobgu/qocache/cache"
 	"github.com/tobgu/qocache/config"
 	"github.com/tobgu/qocache/qlog"
+	"github.com/tobgu/qocache/storage"
 	"net/http"
 	"os"
 	"time"
@@ -13,7 +16,16 @@ import (
 
 type Server struct {
 	http.Server
-	c config.Config
+	c   config.Config
+	app *application
+}
+
+// Shutdown gracefully shuts down the HTTP server and then stops any
+// background activity in the application.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	s.app.close()
+	return err
 }
 
 func (s *Server) ListAndServeAsConfigured() error {
@@ -23,6 +35,26 @@ func (s *Server) ListAndServeAsConfigured() error {
 	return s.ListenAndServe()
 }
 
+// RestoreSnapshot restores datasets from the configured snapshot directory, if any.
+// Returns the number of restored datasets.
+func (s *Server) RestoreSnapshot() (int, error) {
+	if s.c.SnapshotDir == "" {
+		return 0, nil
+	}
+
+	return storage.RestoreSnapshot(s.c.SnapshotDir, s.app.cache)
+}
+
+// WriteSnapshot writes all datasets to the configured snapshot directory, if any.
+// Returns the number of written datasets.
+func (s *Server) WriteSnapshot() (int, error) {
+	if s.c.SnapshotDir == "" {
+		return 0, nil
+	}
+
+	return storage.WriteSnapshot(s.c.SnapshotDir, s.app.cache)
+}
+
 func newHTTPServer(c config.Config, port int, handler http.Handler) http.Server {
 	return http.Server{
 		Addr:              fmt.Sprintf(":%d", port),
@@ -32,13 +64,15 @@ func newHTTPServer(c config.Config, port int, handler http.Handler) http.Server
 		Handler:           handler}
 }
 
+// NewServer creates a server as configured by c. If c.SweepInterval is set expired
+// items are evicted in the background until the server is shut down.
 func NewServer(c config.Config, logger qlog.Logger) (*Server, error) {
-	app, err := Application(c, logger)
+	app, router, err := newApplication(c, logger)
 	if err != nil {
 		return nil, err
 	}
 
-	srv := &Server{Server: newHTTPServer(c, c.Port, app), c: c}
+	srv := &Server{Server: newHTTPServer(c, c.Port, router), c: c, app: app}
 	if c.CertFile != "" {
 		srv.TLSConfig, err = newTLSConfig(c, logger)
 		if err != nil {
@@ -47,6 +81,11 @@ func NewServer(c config.Config, logger qlog.Logger) (*Server, error) {
 		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	}
 
+	// Started last since it is only stopped by Shutdown
+	if c.SweepInterval > 0 {
+		app.sweeper = cache.StartSweeper(app.cache, time.Duration(c.SweepInterval)*time.Second)
+	}
+
 	return srv, nil
 }
 
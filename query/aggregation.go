@@ -0,0 +1,325 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"math"
+	"sort"
+	"sync"
+)
+
+// AggregationFn creates the function used to aggregate a column of type colType
+// in a custom aggregation. args are the values following the alias in the select
+// clause, eg. [95] for ["percentile", "price", "p95", 95].
+//
+// The returned function is called with the values of each group. It must take a
+// slice of the column type, []int, []float64, []bool or []*string for string and
+// enum columns, and return a value of the same type, an int or a float64.
+type AggregationFn func(colType types.DataType, args []interface{}) (interface{}, error)
+
+var customAggregations = struct {
+	sync.RWMutex
+	fns map[string]AggregationFn
+}{fns: make(map[string]AggregationFn)}
+
+// RegisterAggregation makes fn available in select clauses under name. Custom
+// aggregations take precedence over the aggregations built into qframe.
+// Panics if an aggregation with the same name has already been registered.
+func RegisterAggregation(name string, fn AggregationFn) {
+	customAggregations.Lock()
+	defer customAggregations.Unlock()
+
+	if _, ok := customAggregations.fns[name]; ok {
+		panic(fmt.Sprintf("aggregation %s already registered", name))
+	}
+
+	customAggregations.fns[name] = fn
+}
+
+func lookupAggregation(name string) (AggregationFn, bool) {
+	customAggregations.RLock()
+	defer customAggregations.RUnlock()
+	fn, ok := customAggregations.fns[name]
+	return fn, ok
+}
+
+func init() {
+	RegisterAggregation("median", median)
+	RegisterAggregation("percentile", percentile)
+	RegisterAggregation("count_distinct", countDistinct)
+}
+
+func isNativeAggregation(colType types.DataType, fn interface{}) bool {
+	switch fn.(type) {
+	case func([]int) int:
+		return colType == types.Int
+	case func([]float64) float64:
+		return colType == types.Float
+	case func([]bool) bool:
+		return colType == types.Bool
+	case func([]*string) *string:
+		return colType == types.String || colType == types.Enum
+	}
+
+	return false
+}
+
+// customAggregation returns the qframe aggregation for a. Since qframe requires
+// the result of an aggregation to have the same type as the aggregated column,
+// functions returning another type are applied to a new column, added to f, that
+// holds the row numbers. The values are then looked up using the row numbers
+// in each group.
+func customAggregation(f qf.QFrame, a aggregation, newFn AggregationFn, i int) (qf.QFrame, qf.Aggregation, error) {
+	noAgg := qf.Aggregation{}
+	colType, ok := f.ColumnTypeMap()[a.Column]
+	if !ok {
+		return f, noAgg, fmt.Errorf("unknown column in aggregation: %s", a.Column)
+	}
+
+	name := a.Fn.(string)
+	fn, err := newFn(colType, a.args)
+	if err != nil {
+		return f, noAgg, fmt.Errorf("aggregation %s: %v", name, err)
+	}
+
+	result := qf.Aggregation{Fn: fn, Column: a.Column, As: aggregationColumn(a.Aggregation)}
+	if isNativeAggregation(colType, fn) {
+		return f, result, nil
+	}
+
+	intFn, floatFn, err := byRowNum(f, a.Column, fn)
+	if err != nil {
+		return f, noAgg, fmt.Errorf("aggregation %s: %v", name, err)
+	}
+
+	result.Column = fmt.Sprintf("__qocache_aggregation_%d", i)
+	if intFn != nil {
+		result.Fn = intFn
+		return f.WithRowNums(result.Column), result, nil
+	}
+
+	rows := make([]float64, f.Len())
+	for r := range rows {
+		rows[r] = float64(r)
+	}
+	f = withColumn(f, result.Column, rows)
+	result.Fn = func(rowNums []float64) float64 {
+		rows := make([]int, len(rowNums))
+		for i, r := range rowNums {
+			rows[i] = int(r)
+		}
+		return floatFn(rows)
+	}
+
+	return f, result, nil
+}
+
+// byRowNum wraps fn in a function that takes the row numbers of the values to
+// aggregate in column. Either the int or the float function is returned
+// depending on the result type of fn.
+func byRowNum(f qf.QFrame, column string, fn interface{}) (func([]int) int, func([]int) float64, error) {
+	var intFn func([]int) int
+	var floatFn func([]int) float64
+	var err error
+	switch t := fn.(type) {
+	case func([]int) int, func([]int) float64:
+		var view qf.IntView
+		if view, err = f.IntView(column); err != nil {
+			break
+		}
+		values := view.Slice()
+		gather := func(rows []int) []int {
+			result := make([]int, len(rows))
+			for i, r := range rows {
+				result[i] = values[r]
+			}
+			return result
+		}
+
+		if g, ok := t.(func([]int) int); ok {
+			intFn = func(rows []int) int { return g(gather(rows)) }
+		} else {
+			g := t.(func([]int) float64)
+			floatFn = func(rows []int) float64 { return g(gather(rows)) }
+		}
+	case func([]float64) int, func([]float64) float64:
+		var view qf.FloatView
+		if view, err = f.FloatView(column); err != nil {
+			break
+		}
+		values := view.Slice()
+		gather := func(rows []int) []float64 {
+			result := make([]float64, len(rows))
+			for i, r := range rows {
+				result[i] = values[r]
+			}
+			return result
+		}
+
+		if g, ok := t.(func([]float64) int); ok {
+			intFn = func(rows []int) int { return g(gather(rows)) }
+		} else {
+			g := t.(func([]float64) float64)
+			floatFn = func(rows []int) float64 { return g(gather(rows)) }
+		}
+	case func([]bool) int, func([]bool) float64:
+		var view qf.BoolView
+		if view, err = f.BoolView(column); err != nil {
+			break
+		}
+		values := view.Slice()
+		gather := func(rows []int) []bool {
+			result := make([]bool, len(rows))
+			for i, r := range rows {
+				result[i] = values[r]
+			}
+			return result
+		}
+
+		if g, ok := t.(func([]bool) int); ok {
+			intFn = func(rows []int) int { return g(gather(rows)) }
+		} else {
+			g := t.(func([]bool) float64)
+			floatFn = func(rows []int) float64 { return g(gather(rows)) }
+		}
+	case func([]*string) int, func([]*string) float64:
+		var values []*string
+		if view, sErr := f.StringView(column); sErr == nil {
+			values = view.Slice()
+		} else if view, eErr := f.EnumView(column); eErr == nil {
+			values = view.Slice()
+		} else {
+			err = sErr
+			break
+		}
+
+		gather := func(rows []int) []*string {
+			result := make([]*string, len(rows))
+			for i, r := range rows {
+				result[i] = values[r]
+			}
+			return result
+		}
+
+		if g, ok := t.(func([]*string) int); ok {
+			intFn = func(rows []int) int { return g(gather(rows)) }
+		} else {
+			g := t.(func([]*string) float64)
+			floatFn = func(rows []int) float64 { return g(gather(rows)) }
+		}
+	default:
+		err = fmt.Errorf("unsupported function type %T for column %s", fn, column)
+	}
+
+	return intFn, floatFn, err
+}
+
+func median(colType types.DataType, args []interface{}) (interface{}, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("no arguments expected, was: %v", args)
+	}
+
+	return percentileFn(colType, 50)
+}
+
+// percentile takes the percentile, 0 - 100, as argument. Values between
+// two data points are interpolated linearly.
+func percentile(colType types.DataType, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected one argument, the percentile, was: %v", args)
+	}
+
+	p, ok := args[0].(float64)
+	if !ok || p < 0 || p > 100 {
+		return nil, fmt.Errorf("percentile must be a number between 0 and 100, was: %v", args[0])
+	}
+
+	return percentileFn(colType, p)
+}
+
+func percentileFn(colType types.DataType, p float64) (interface{}, error) {
+	switch colType {
+	case types.Int:
+		return func(xs []int) float64 {
+			values := make([]float64, len(xs))
+			for i, x := range xs {
+				values[i] = float64(x)
+			}
+			return percentileOf(values, p)
+		}, nil
+	case types.Float:
+		return func(xs []float64) float64 {
+			values := make([]float64, 0, len(xs))
+			for _, x := range xs {
+				if !math.IsNaN(x) {
+					values = append(values, x)
+				}
+			}
+			return percentileOf(values, p)
+		}, nil
+	default:
+		return nil, fmt.Errorf("not supported for %s columns", colType)
+	}
+}
+
+// percentileOf returns percentile p of values, NaN if values is empty.
+// values is sorted in place.
+func percentileOf(values []float64, p float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+
+	sort.Float64s(values)
+	rank := p / 100 * float64(len(values)-1)
+	lo, hi := int(math.Floor(rank)), int(math.Ceil(rank))
+	return values[lo] + (values[hi]-values[lo])*(rank-float64(lo))
+}
+
+// countDistinct counts the number of distinct non null values.
+func countDistinct(colType types.DataType, args []interface{}) (interface{}, error) {
+	if len(args) > 0 {
+		return nil, fmt.Errorf("no arguments expected, was: %v", args)
+	}
+
+	switch colType {
+	case types.Int:
+		return func(xs []int) int {
+			seen := make(map[int]struct{})
+			for _, x := range xs {
+				seen[x] = struct{}{}
+			}
+			return len(seen)
+		}, nil
+	case types.Float:
+		return func(xs []float64) int {
+			seen := make(map[float64]struct{})
+			for _, x := range xs {
+				if !math.IsNaN(x) {
+					seen[x] = struct{}{}
+				}
+			}
+			return len(seen)
+		}, nil
+	case types.Bool:
+		return func(xs []bool) int {
+			seen := make(map[bool]struct{})
+			for _, x := range xs {
+				seen[x] = struct{}{}
+			}
+			return len(seen)
+		}, nil
+	case types.String, types.Enum:
+		return func(xs []*string) int {
+			seen := make(map[string]struct{})
+			for _, x := range xs {
+				if x != nil {
+					seen[*x] = struct{}{}
+				}
+			}
+			return len(seen)
+		}, nil
+	default:
+		return nil, fmt.Errorf("not supported for %s columns", colType)
+	}
+}
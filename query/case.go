@@ -0,0 +1,140 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"strconv"
+)
+
+const caseRowNumColumn = "__qocache_case_row_num"
+
+// caseExpr is a conditional alias expression:
+// ["case", [condition, value], [condition, value], ..., default]
+//
+// Conditions use the same syntax as where clauses, including expressions and
+// subqueries. Values and the optional default are alias expressions. Each row
+// gets the value of the first matching condition, the default if no condition
+// matches or null if there is no default.
+//
+// The type of the result is decided as described in commonType.
+type caseExpr struct {
+	conditions []interface{}
+
+	// The default, if any, is the last value
+	values []expression
+
+	hasDefault bool
+}
+
+func isCaseBranch(x interface{}) bool {
+	l, ok := x.([]interface{})
+	if !ok || len(l) != 2 {
+		return false
+	}
+
+	_, ok = l[0].([]interface{})
+	return ok
+}
+
+func createCase(dstCol string, input []interface{}) (*caseExpr, error) {
+	c := &caseExpr{}
+	for i, x := range input[1:] {
+		var value interface{}
+		if isCaseBranch(x) {
+			branch := x.([]interface{})
+			c.conditions = append(c.conditions, branch[0])
+			value = branch[1]
+		} else if i == len(input)-2 && len(c.conditions) > 0 {
+			value = x
+			c.hasDefault = true
+		} else {
+			return nil, fmt.Errorf("invalid case expression, expected [condition, value] or default last, was: %v", x)
+		}
+
+		e, err := parseExpression(value, fmt.Sprintf("%s__qocache_case_%d", dstCol, i))
+		if err != nil {
+			return nil, err
+		}
+		c.values = append(c.values, e)
+	}
+
+	if len(c.conditions) == 0 {
+		return nil, fmt.Errorf("invalid case expression, at least one [condition, value] required, was: %v", input)
+	}
+
+	return c, nil
+}
+
+// choices returns the index of the value to use for each row in f,
+// -1 for rows that should be null. Temporary columns are named after dstCol.
+func (c *caseExpr) choices(f qf.QFrame, dstCol string, datasets DatasetFn) ([]int, error) {
+	result := make([]int, f.Len())
+	for i := range result {
+		result[i] = -1
+		if c.hasDefault {
+			result[i] = len(c.conditions)
+		}
+	}
+
+	withRowNums := f.WithRowNums(caseRowNumColumn)
+	matched := make([]bool, f.Len())
+	for i, cond := range c.conditions {
+		prefix := fmt.Sprintf("%s__qocache_case_cond_%d", dstCol, i)
+		filtered := filterWithExpressions(withRowNums, cond, prefix, datasets, func(c qf.FilterClause) qf.FilterClause { return c })
+		if filtered.Err != nil {
+			return nil, filtered.Err
+		}
+
+		for _, r := range filtered.MustIntView(caseRowNumColumn).Slice() {
+			if !matched[r] {
+				matched[r] = true
+				result[r] = i
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (c *caseExpr) eval(f qf.QFrame, dstCol string, datasets DatasetFn) qf.QFrame {
+	if f.Err != nil {
+		return f
+	}
+
+	choices, err := c.choices(f, dstCol, datasets)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	f, valueCols := evalArgs(f, c.values, dstCol, datasets)
+	if f.Err != nil {
+		return f
+	}
+
+	values, err := pick(f, valueCols, choices)
+	if err != nil {
+		return qf.QFrame{Err: fmt.Errorf("case: %v", err)}
+	}
+
+	return withColumn(f.Drop(valueCols...), dstCol, values)
+}
+
+// stringSlice returns the values in column as strings, bools
+// are converted to strings.
+func stringSlice(f qf.QFrame, column string) []*string {
+	switch f.ColumnTypeMap()[column] {
+	case types.Bool:
+		bools := f.MustBoolView(column).Slice()
+		result := make([]*string, len(bools))
+		for i, b := range bools {
+			s := strconv.FormatBool(b)
+			result[i] = &s
+		}
+		return result
+	case types.Enum:
+		return f.MustEnumView(column).Slice()
+	default:
+		return f.MustStringView(column).Slice()
+	}
+}
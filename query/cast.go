@@ -0,0 +1,213 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"github.com/tobgu/qocache/storage"
+	qostrings "github.com/tobgu/qocache/strings"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// castExpr converts the result of an expression to another type:
+// ["cast", expr, type] or ["try_cast", expr, type], type is one of int, float,
+// string, bool or enum. cast fails on values that cannot be converted while
+// try_cast converts them to null.
+//
+// Floats are truncated when cast to int. Casts to int and bool with null values
+// in the result give float and string columns, see commonType.
+type castExpr struct {
+	expr expression
+	typ  types.DataType
+	try  bool
+}
+
+func createCast(dstCol string, input []interface{}) (castExpr, error) {
+	if len(input) != 3 {
+		return castExpr{}, fmt.Errorf("invalid cast expression, expected [%v, expression, type], was: %v", input[0], input)
+	}
+
+	typ, ok := input[2].(string)
+	if !ok {
+		return castExpr{}, fmt.Errorf("invalid cast type, expected string, was: %v", input[2])
+	}
+
+	result := castExpr{typ: types.DataType(qostrings.TrimQuotes(typ)), try: input[0] == "try_cast"}
+	switch result.typ {
+	case types.Int, types.Float, types.String, types.Bool, types.Enum:
+	default:
+		return castExpr{}, fmt.Errorf("invalid cast type %s, valid types are int, float, string, bool and enum", typ)
+	}
+
+	var err error
+	result.expr, err = parseExpression(input[1], dstCol+"__qocache_cast")
+	return result, err
+}
+
+func (c castExpr) eval(f qf.QFrame, dstCol string, datasets DatasetFn) qf.QFrame {
+	srcCol := dstCol + "__qocache_cast"
+	f = c.expr.eval(f, srcCol, datasets)
+	if f.Err != nil {
+		return f
+	}
+
+	values, err := c.convert(f, srcCol)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	f = withColumn(f.Drop(srcCol), dstCol, values)
+	if c.typ == types.Enum {
+		return storage.ToEnum(f, dstCol)
+	}
+
+	return f
+}
+
+func (c castExpr) convert(f qf.QFrame, col string) (interface{}, error) {
+	srcType := f.ColumnTypeMap()[col]
+	if srcType == c.typ && srcType != types.Enum {
+		return columnValues(f, col), nil
+	}
+
+	strs := anyStringArg(f, col)
+	nulls := make([]bool, len(strs))
+	for i, s := range strs {
+		nulls[i] = s == nil
+	}
+
+	// fail returns the error for a value that cannot be converted or
+	// marks it as null for try_cast.
+	fail := func(i int) error {
+		if c.try {
+			nulls[i] = true
+			return nil
+		}
+		return fmt.Errorf("cannot cast %q to %s, use try_cast to get null for such values", *strs[i], c.typ)
+	}
+
+	switch c.typ {
+	case types.Int:
+		var floats []float64
+		if srcType == types.Float {
+			floats = f.MustFloatView(col).Slice()
+		}
+
+		result := make([]int, len(strs))
+		for i, s := range strs {
+			var err error
+			switch {
+			case nulls[i]:
+			case srcType == types.Float:
+				if math.IsInf(floats[i], 0) {
+					err = fail(i)
+				}
+				result[i] = int(floats[i])
+			case srcType == types.Bool:
+				if *s == "true" {
+					result[i] = 1
+				}
+			default:
+				if result[i], err = strconv.Atoi(strings.TrimSpace(*s)); err != nil {
+					err = fail(i)
+				}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+		return intsOrFloats(result, nulls), nil
+	case types.Float:
+		result := make([]float64, len(strs))
+		for i, s := range strs {
+			result[i] = math.NaN()
+			var err error
+			switch {
+			case nulls[i]:
+			case srcType == types.Bool:
+				result[i] = 0
+				if *s == "true" {
+					result[i] = 1
+				}
+			default:
+				if result[i], err = strconv.ParseFloat(strings.TrimSpace(*s), 64); err != nil {
+					result[i] = math.NaN()
+					err = fail(i)
+				}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+		return result, nil
+	case types.Bool:
+		var floats []float64
+		if srcType == types.Int || srcType == types.Float {
+			floats, _ = floatValues(f, col)
+		}
+
+		result := make([]bool, len(strs))
+		for i, s := range strs {
+			var err error
+			switch {
+			case nulls[i]:
+			case floats != nil:
+				result[i] = floats[i] != 0
+			default:
+				if result[i], err = strconv.ParseBool(strings.TrimSpace(*s)); err != nil {
+					err = fail(i)
+				}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+		}
+		return boolsOrStrings(result, nulls), nil
+	default:
+		// String and enum
+		return strs, nil
+	}
+}
+
+// columnValues returns the values of column as a []int, []float64, []bool
+// or []*string.
+func columnValues(f qf.QFrame, column string) interface{} {
+	switch f.ColumnTypeMap()[column] {
+	case types.Int:
+		return f.MustIntView(column).Slice()
+	case types.Float:
+		return f.MustFloatView(column).Slice()
+	case types.Bool:
+		return f.MustBoolView(column).Slice()
+	default:
+		return stringSlice(f, column)
+	}
+}
+
+// boolsOrStrings returns values as bools unless any of them is null in which
+// case they are returned as strings.
+func boolsOrStrings(values []bool, nulls []bool) interface{} {
+	hasNull := false
+	for _, n := range nulls {
+		hasNull = hasNull || n
+	}
+
+	if !hasNull {
+		return values
+	}
+
+	result := make([]*string, len(values))
+	for i, b := range values {
+		if !nulls[i] {
+			s := strconv.FormatBool(b)
+			result[i] = &s
+		}
+	}
+
+	return result
+}
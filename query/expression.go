@@ -0,0 +1,391 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/config/eval"
+	"github.com/tobgu/qframe/types"
+	qostrings "github.com/tobgu/qocache/strings"
+	"math"
+	"strconv"
+)
+
+// expression is a parsed alias expression.
+type expression interface {
+	// eval evaluates the expression on f, the result is stored in dstCol.
+	// datasets is used to look up datasets referenced in subqueries.
+	eval(f qf.QFrame, dstCol string, datasets DatasetFn) qf.QFrame
+}
+
+// function is a function in alias expressions that is implemented in qocache
+// rather than in qframe. Unlike the functions in evalContext it may take any
+// number of arguments of mixed types.
+type function struct {
+	minArgs int
+
+	// -1 for any number of arguments
+	maxArgs int
+
+	// fn is called with f and the names of the columns in f holding the
+	// evaluated arguments. It returns a []int, []float64, []bool or []*string
+	// with one value per row in f.
+	fn func(f qf.QFrame, args []string) (interface{}, error)
+}
+
+// qfExpr is an expression that is evaluated entirely by qframe.
+type qfExpr struct {
+	expr qf.Expression
+}
+
+func (e qfExpr) eval(f qf.QFrame, dstCol string, _ DatasetFn) qf.QFrame {
+	return f.Eval(dstCol, e.expr, eval.EvalContext(evalContext))
+}
+
+// opExpr is a qframe operation with arguments that cannot be evaluated by qframe.
+type opExpr struct {
+	op   string
+	args []expression
+}
+
+func (e opExpr) eval(f qf.QFrame, dstCol string, datasets DatasetFn) qf.QFrame {
+	f, argCols := evalArgs(f, e.args, dstCol, datasets)
+	expr := []interface{}{e.op}
+	for _, c := range argCols {
+		expr = append(expr, types.ColumnName(c))
+	}
+
+	return f.Eval(dstCol, qf.Val(expr), eval.EvalContext(evalContext)).Drop(argCols...)
+}
+
+// callExpr is a call to one of the functions in functions.
+type callExpr struct {
+	name string
+	fn   function
+	args []expression
+}
+
+func (e callExpr) eval(f qf.QFrame, dstCol string, datasets DatasetFn) qf.QFrame {
+	f, argCols := evalArgs(f, e.args, dstCol, datasets)
+	if f.Err != nil {
+		return f
+	}
+
+	result, err := e.fn.fn(f, argCols)
+	if err != nil {
+		return qf.QFrame{Err: fmt.Errorf("%s: %v", e.name, err)}
+	}
+
+	return withColumn(f.Drop(argCols...), dstCol, result)
+}
+
+// evalArgs evaluates args into temporary columns named after dstCol.
+func evalArgs(f qf.QFrame, args []expression, dstCol string, datasets DatasetFn) (qf.QFrame, []string) {
+	cols := make([]string, len(args))
+	for i, a := range args {
+		cols[i] = fmt.Sprintf("%s__qocache_arg_%d", dstCol, i)
+		f = a.eval(f, cols[i], datasets)
+	}
+
+	return f, cols
+}
+
+// expressionColumns returns the names of the columns referenced in the alias
+// expression expr, without validating the expression. Any unquoted string that
+// is not an operator or function name is considered a column.
+func expressionColumns(expr interface{}) []string {
+	result := make([]string, 0)
+	switch t := expr.(type) {
+	case []interface{}:
+		for i, x := range t {
+			if _, ok := x.(string); ok && i == 0 {
+				// Operator or function name
+				continue
+			}
+			result = append(result, expressionColumns(x)...)
+		}
+	case string:
+		if !qostrings.IsQuoted(t) {
+			result = append(result, t)
+		}
+	}
+
+	return result
+}
+
+// needsFunctionLayer returns true if expr, or any sub expression, cannot be
+// evaluated by qframe.
+func needsFunctionLayer(expr interface{}) bool {
+	l, ok := expr.([]interface{})
+	if !ok || len(l) == 0 {
+		return false
+	}
+
+	if op, ok := l[0].(string); ok {
+		if _, ok := functions[op]; ok || op == "case" || op == "cast" || op == "try_cast" {
+			return true
+		}
+	}
+
+	for _, x := range l[1:] {
+		if needsFunctionLayer(x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseExpression parses an alias expression as decoded from JSON. dstCol
+// is used to name any temporary columns needed to evaluate the expression.
+func parseExpression(expr interface{}, dstCol string) (expression, error) {
+	if !needsFunctionLayer(expr) {
+		prepareAlias(&expr)
+		if err := checkConstArgs(expr); err != nil {
+			return nil, err
+		}
+
+		e := qf.Val(expr)
+		return qfExpr{expr: e}, e.Err()
+	}
+
+	l := expr.([]interface{})
+	op, ok := l[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid operation in alias expression: %v", l[0])
+	}
+
+	if op == "case" {
+		return createCase(dstCol, l)
+	}
+
+	if op == "cast" || op == "try_cast" {
+		return createCast(dstCol, l)
+	}
+
+	args := make([]expression, 0, len(l)-1)
+	for i, x := range l[1:] {
+		arg, err := parseExpression(x, fmt.Sprintf("%s__qocache_arg_%d", dstCol, i))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+
+	fn, ok := functions[op]
+	if !ok {
+		if len(args) > 2 {
+			return nil, fmt.Errorf("invalid alias expression, expected one or two arguments to %s, was: %v", op, l)
+		}
+		return opExpr{op: op, args: args}, nil
+	}
+
+	if len(args) < fn.minArgs || (fn.maxArgs >= 0 && len(args) > fn.maxArgs) {
+		return nil, fmt.Errorf("invalid number of arguments to %s: %v", op, l)
+	}
+
+	return callExpr{name: op, fn: fn, args: args}, nil
+}
+
+// withColumn returns f with values, a []int, []float64, []bool or []*string, in column.
+func withColumn(f qf.QFrame, column string, values interface{}) qf.QFrame {
+	i := -1
+	var fn interface{}
+	switch v := values.(type) {
+	case []int:
+		fn = func() int { i++; return v[i] }
+	case []float64:
+		fn = func() float64 { i++; return v[i] }
+	case []bool:
+		fn = func() bool { i++; return v[i] }
+	case []*string:
+		fn = func() *string { i++; return v[i] }
+	default:
+		return qf.QFrame{Err: fmt.Errorf("unexpected column data %T", values)}
+	}
+
+	return f.Apply(qf.Instruction{DstCol: column, Fn: fn})
+}
+
+// commonType returns the type that can hold the values of all columns. Int and
+// float columns may be mixed, the result is then a float. Since int and bool
+// columns cannot hold null values int becomes float and bool becomes string if
+// hasNull is true.
+func commonType(f qf.QFrame, columns []string, hasNull bool) (types.DataType, error) {
+	var result types.DataType
+	for _, col := range columns {
+		t := f.ColumnTypeMap()[col]
+		if t == types.Enum {
+			t = types.String
+		}
+
+		switch {
+		case result == "" || result == t:
+			result = t
+		case (result == types.Int && t == types.Float) || (result == types.Float && t == types.Int):
+			result = types.Float
+		default:
+			return "", fmt.Errorf("incompatible types %s and %s", result, t)
+		}
+	}
+
+	if hasNull && result == types.Int {
+		return types.Float, nil
+	}
+
+	if hasNull && result == types.Bool {
+		return types.String, nil
+	}
+
+	return result, nil
+}
+
+// pick returns the value, for each row, of the column in columns given by the
+// index in choices. A negative index results in null. The type of the result
+// is given by commonType.
+func pick(f qf.QFrame, columns []string, choices []int) (interface{}, error) {
+	hasNull := false
+	for _, choice := range choices {
+		hasNull = hasNull || choice < 0
+	}
+
+	resultType, err := commonType(f, columns, hasNull)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resultType {
+	case types.Int:
+		values := make([][]int, len(columns))
+		for i, col := range columns {
+			values[i] = f.MustIntView(col).Slice()
+		}
+
+		result := make([]int, len(choices))
+		for row, choice := range choices {
+			result[row] = values[choice][row]
+		}
+		return result, nil
+	case types.Float:
+		values := make([][]float64, len(columns))
+		for i, col := range columns {
+			values[i], _ = floatValues(f, col)
+		}
+
+		result := make([]float64, len(choices))
+		for row, choice := range choices {
+			result[row] = math.NaN()
+			if choice >= 0 {
+				result[row] = values[choice][row]
+			}
+		}
+		return result, nil
+	case types.Bool:
+		values := make([][]bool, len(columns))
+		for i, col := range columns {
+			values[i] = f.MustBoolView(col).Slice()
+		}
+
+		result := make([]bool, len(choices))
+		for row, choice := range choices {
+			result[row] = values[choice][row]
+		}
+		return result, nil
+	default:
+		values := make([][]*string, len(columns))
+		for i, col := range columns {
+			values[i] = stringSlice(f, col)
+		}
+
+		result := make([]*string, len(choices))
+		for row, choice := range choices {
+			if choice >= 0 {
+				result[row] = values[choice][row]
+			}
+		}
+		return result, nil
+	}
+}
+
+// intsOrFloats returns values as ints unless any of them is null in which case
+// they are returned as floats with NaN for the null values.
+func intsOrFloats(values []int, nulls []bool) interface{} {
+	hasNull := false
+	for _, n := range nulls {
+		hasNull = hasNull || n
+	}
+
+	if !hasNull {
+		return values
+	}
+
+	result := make([]float64, len(values))
+	for i, x := range values {
+		result[i] = float64(x)
+		if nulls[i] {
+			result[i] = math.NaN()
+		}
+	}
+
+	return result
+}
+
+// stringArg returns the values of a string or enum argument.
+func stringArg(f qf.QFrame, column string) ([]*string, error) {
+	switch f.ColumnTypeMap()[column] {
+	case types.String:
+		return f.MustStringView(column).Slice(), nil
+	case types.Enum:
+		return f.MustEnumView(column).Slice(), nil
+	default:
+		return nil, fmt.Errorf("expected string argument, was %s", f.ColumnTypeMap()[column])
+	}
+}
+
+// intArg returns the values of an integer argument. Since numbers in JSON are
+// floats float arguments are accepted as long as all values are integers.
+func intArg(f qf.QFrame, column string) ([]int, error) {
+	switch f.ColumnTypeMap()[column] {
+	case types.Int:
+		return f.MustIntView(column).Slice(), nil
+	case types.Float:
+		floats := f.MustFloatView(column).Slice()
+		result := make([]int, len(floats))
+		for i, x := range floats {
+			if x != math.Trunc(x) || math.IsInf(x, 0) {
+				return nil, fmt.Errorf("expected integer argument, was %v", x)
+			}
+			result[i] = int(x)
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("expected integer argument, was %s", f.ColumnTypeMap()[column])
+	}
+}
+
+// anyStringArg returns the values of an argument of any type as strings.
+func anyStringArg(f qf.QFrame, column string) []*string {
+	var result []*string
+	format := func(n int, fn func(i int) (string, bool)) {
+		result = make([]*string, n)
+		for i := range result {
+			if s, ok := fn(i); ok {
+				result[i] = &s
+			}
+		}
+	}
+
+	switch f.ColumnTypeMap()[column] {
+	case types.Int:
+		v := f.MustIntView(column).Slice()
+		format(len(v), func(i int) (string, bool) { return strconv.Itoa(v[i]), true })
+	case types.Float:
+		v := f.MustFloatView(column).Slice()
+		format(len(v), func(i int) (string, bool) {
+			return strconv.FormatFloat(v[i], 'f', -1, 64), !math.IsNaN(v[i])
+		})
+	default:
+		result = stringSlice(f, column)
+	}
+
+	return result
+}
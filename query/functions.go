@@ -0,0 +1,184 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/config/eval"
+	"github.com/tobgu/qframe/types"
+	"github.com/tobgu/qocache/datetime"
+	"math"
+	"time"
+)
+
+// evalContext holds the functions, with one or two arguments of the same
+// type, available in alias expressions in addition to the ones built into
+// qframe.
+var evalContext = newEvalContext()
+
+func newEvalContext() *eval.Context {
+	ctx := eval.NewDefaultCtx()
+	fns := map[string]interface{}{
+		"year":        datePart(func(t time.Time) int { return t.Year() }),
+		"month":       datePart(func(t time.Time) int { return int(t.Month()) }),
+		"day":         datePart(func(t time.Time) int { return t.Day() }),
+		"hour":        datePart(func(t time.Time) int { return t.Hour() }),
+		"minute":      datePart(func(t time.Time) int { return t.Minute() }),
+		"second":      datePart(func(t time.Time) int { return t.Second() }),
+		"date_trunc":  dateTrunc,
+		"date_format": dateFormat,
+	}
+
+	for name, fn := range fns {
+		if err := ctx.SetFunc(name, fn); err != nil {
+			panic(err)
+		}
+	}
+
+	return ctx
+}
+
+// functions holds the functions in alias expressions implemented in qocache,
+// see function.
+var functions = map[string]function{
+	"substr":     {minArgs: 2, maxArgs: 3, fn: substr},
+	"concat":     {minArgs: 1, maxArgs: -1, fn: concat},
+	"trim":       {minArgs: 1, maxArgs: 2, fn: trim},
+	"length":     {minArgs: 1, maxArgs: 1, fn: length},
+	"replace":    {minArgs: 3, maxArgs: 3, fn: replace},
+	"split_part": {minArgs: 3, maxArgs: 3, fn: splitPart},
+	"round":      {minArgs: 1, maxArgs: 2, fn: round},
+	"floor":      {minArgs: 1, maxArgs: 1, fn: intPreserving(math.Floor)},
+	"ceil":       {minArgs: 1, maxArgs: 1, fn: intPreserving(math.Ceil)},
+	"sqrt":       {minArgs: 1, maxArgs: 1, fn: unaryMath(math.Sqrt)},
+	"log":        {minArgs: 1, maxArgs: 2, fn: log},
+	"pow":        {minArgs: 2, maxArgs: 2, fn: pow},
+	"coalesce":   {minArgs: 1, maxArgs: -1, fn: coalesce},
+	"nullif":     {minArgs: 2, maxArgs: 2, fn: nullif},
+	"is_null":    {minArgs: 1, maxArgs: 1, fn: isNull},
+}
+
+// constArgChecks validates constant arguments to functions when the alias
+// expression is created since the functions themselves cannot return errors.
+var constArgChecks = map[string]func(arg string) error{
+	"date_trunc": func(unit string) error {
+		_, err := datetime.Truncate(time.Time{}, unit)
+		return err
+	},
+	"date_format": func(format string) error {
+		_, err := datetime.Layout(format)
+		return err
+	},
+}
+
+// checkConstArgs walks a prepared alias expression and validates the constant
+// arguments of functions in constArgChecks.
+func checkConstArgs(expr interface{}) error {
+	l, ok := expr.([]interface{})
+	if !ok || len(l) == 0 {
+		return nil
+	}
+
+	if name, ok := l[0].(string); ok {
+		if check, ok := constArgChecks[name]; ok {
+			for _, arg := range l[1:] {
+				if s, ok := arg.(string); ok {
+					if err := check(s); err != nil {
+						return fmt.Errorf("%s: %v", name, err)
+					}
+				}
+			}
+		}
+	}
+
+	for _, arg := range l[1:] {
+		if err := checkConstArgs(arg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseDatetime(s *string) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+
+	t, err := datetime.ParseISO(*s, time.UTC)
+	return t, err == nil
+}
+
+// datePart returns a function that extracts a part of a datetime. The result
+// is a float, null (NaN) for null values and strings that are not ISO 8601
+// datetimes, see commonType.
+func datePart(part func(time.Time) int) func(*string) float64 {
+	return func(s *string) float64 {
+		if t, ok := parseDatetime(s); ok {
+			return float64(part(t.UTC()))
+		}
+		return math.NaN()
+	}
+}
+
+// dateTrunc truncates a datetime to unit, see datetime.Truncate.
+func dateTrunc(s, unit *string) *string {
+	t, ok := parseDatetime(s)
+	if !ok || unit == nil {
+		return nil
+	}
+
+	t, err := datetime.Truncate(t, *unit)
+	if err != nil {
+		return nil
+	}
+
+	result := datetime.Format(t)
+	return &result
+}
+
+// dateFormat formats a datetime, in UTC, according to a strftime style format.
+func dateFormat(s, format *string) *string {
+	t, ok := parseDatetime(s)
+	if !ok || format == nil {
+		return nil
+	}
+
+	l, err := datetime.Layout(*format)
+	if err != nil {
+		return nil
+	}
+
+	result := t.UTC().Format(l)
+	return &result
+}
+
+var datetimeComparators = map[string]bool{"<": true, "<=": true, "=": true, "==": true, "!=": true, ">=": true, ">": true}
+
+// datetimeLiteral converts an ISO 8601 literal, UTC unless a time zone is
+// given, to the format used in datetime columns so that they can be compared.
+func datetimeLiteral(s string) (string, error) {
+	t, err := datetime.ParseISO(s, time.UTC)
+	if err != nil {
+		return "", fmt.Errorf("invalid datetime in comparison: %v", err)
+	}
+
+	return datetime.Format(t), nil
+}
+
+// isDatetimeColumn returns true if column is a string column holding
+// datetimes. Since there is no datetime type in qframe this is decided
+// by the format of the first non null value.
+func isDatetimeColumn(f qf.QFrame, column string) bool {
+	if f.ColumnTypeMap()[column] != types.String {
+		return false
+	}
+
+	view := f.MustStringView(column)
+	for i := 0; i < view.Len(); i++ {
+		if s := view.ItemAt(i); s != nil {
+			return datetime.IsFormatted(*s)
+		}
+	}
+
+	return false
+}
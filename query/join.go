@@ -0,0 +1,86 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qocache/storage"
+)
+
+// DatasetFn returns the dataset stored under key. It is used to resolve
+// references to other datasets than the one queried.
+type DatasetFn func(key string) (qf.QFrame, bool)
+
+type joinClause struct {
+	// Key of the dataset to join with
+	Dataset string `json:"dataset"`
+
+	// List of columns with the same name in both datasets or [left, right]
+	// pairs of columns with different names.
+	On []interface{} `json:"on"`
+
+	// "inner" (default) or "left"
+	How string `json:"how"`
+
+	// Prefix added to columns in the joined dataset with the same name as a
+	// column in the queried dataset, defaults to "<dataset>_".
+	Prefix *string `json:"prefix"`
+}
+
+func unMarshalJoinOn(input []interface{}) ([]storage.JoinOn, error) {
+	result := make([]storage.JoinOn, 0, len(input))
+	for _, x := range input {
+		switch t := x.(type) {
+		case string:
+			result = append(result, storage.JoinOn{Left: t, Right: t})
+		case []interface{}:
+			if len(t) != 2 {
+				return nil, fmt.Errorf("invalid join column pair, expected [left, right], was: %v", t)
+			}
+
+			l, lOk := t[0].(string)
+			r, rOk := t[1].(string)
+			if !lOk || !rOk {
+				return nil, fmt.Errorf("invalid join column pair, expected [left, right], was: %v", t)
+			}
+			result = append(result, storage.JoinOn{Left: l, Right: r})
+		default:
+			return nil, fmt.Errorf("invalid join column, expected string or [left, right], was: %v", x)
+		}
+	}
+
+	return result, nil
+}
+
+func (j joinClause) join(f qf.QFrame, datasets DatasetFn) qf.QFrame {
+	var joinType storage.JoinType
+	switch j.How {
+	case "", "inner":
+		joinType = storage.InnerJoin
+	case "left":
+		joinType = storage.LeftJoin
+	default:
+		return qf.QFrame{Err: fmt.Errorf("unknown join type: %s, valid types are inner and left", j.How)}
+	}
+
+	on, err := unMarshalJoinOn(j.On)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	var other qf.QFrame
+	ok := false
+	if datasets != nil {
+		other, ok = datasets(j.Dataset)
+	}
+
+	if !ok {
+		return qf.QFrame{Err: fmt.Errorf("dataset to join with not found: %s", j.Dataset)}
+	}
+
+	prefix := j.Dataset + "_"
+	if j.Prefix != nil {
+		prefix = *j.Prefix
+	}
+
+	return storage.Join(f, other, on, joinType, prefix)
+}
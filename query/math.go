@@ -0,0 +1,183 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"math"
+)
+
+// Math and null handling functions in alias expressions. Numeric functions
+// return floats except round, floor and ceil which keep int arguments as ints.
+
+// mapFloats applies fn to the values of the numeric argument col.
+func mapFloats(f qf.QFrame, col string, fn func(i int, x float64) float64) ([]float64, error) {
+	values, err := floatArg(f, col)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]float64, len(values))
+	for i, x := range values {
+		result[i] = fn(i, x)
+	}
+
+	return result, nil
+}
+
+// round(x[, digits]) rounds half away from zero to the given number of
+// decimal digits, 0 by default. digits may be negative.
+func round(f qf.QFrame, args []string) (interface{}, error) {
+	digits := make([]int, f.Len())
+	if digitsCol := optionalArg(args, 1); digitsCol != nil {
+		var err error
+		if digits, err = intArg(f, *digitsCol); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.ColumnTypeMap()[args[0]] == types.Int {
+		values := f.MustIntView(args[0]).Slice()
+		result := make([]int, len(values))
+		for i, x := range values {
+			result[i] = x
+			if digits[i] < 0 {
+				p := math.Pow10(-digits[i])
+				result[i] = int(math.Round(float64(x)/p) * p)
+			}
+		}
+		return result, nil
+	}
+
+	return mapFloats(f, args[0], func(i int, x float64) float64 {
+		p := math.Pow10(digits[i])
+		return math.Round(x*p) / p
+	})
+}
+
+// intPreserving returns a function that applies fn to float arguments and
+// returns int arguments as they are.
+func intPreserving(fn func(float64) float64) func(qf.QFrame, []string) (interface{}, error) {
+	return func(f qf.QFrame, args []string) (interface{}, error) {
+		if f.ColumnTypeMap()[args[0]] == types.Int {
+			return f.MustIntView(args[0]).Slice(), nil
+		}
+
+		return mapFloats(f, args[0], func(_ int, x float64) float64 { return fn(x) })
+	}
+}
+
+// unaryMath returns a function that applies fn to a numeric argument.
+func unaryMath(fn func(float64) float64) func(qf.QFrame, []string) (interface{}, error) {
+	return func(f qf.QFrame, args []string) (interface{}, error) {
+		return mapFloats(f, args[0], func(_ int, x float64) float64 { return fn(x) })
+	}
+}
+
+// log(x[, base]), the natural logarithm unless a base is given.
+func log(f qf.QFrame, args []string) (interface{}, error) {
+	var bases []float64
+	if baseCol := optionalArg(args, 1); baseCol != nil {
+		var err error
+		if bases, err = floatArg(f, *baseCol); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapFloats(f, args[0], func(i int, x float64) float64 {
+		if bases == nil {
+			return math.Log(x)
+		}
+		return math.Log(x) / math.Log(bases[i])
+	})
+}
+
+// pow(x, y) returns x raised to the power of y.
+func pow(f qf.QFrame, args []string) (interface{}, error) {
+	exponents, err := floatArg(f, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return mapFloats(f, args[0], func(i int, x float64) float64 { return math.Pow(x, exponents[i]) })
+}
+
+// coalesce(value, ...) returns the first non null value.
+func coalesce(f qf.QFrame, args []string) (interface{}, error) {
+	nulls := make([][]bool, len(args))
+	for i, a := range args {
+		nulls[i] = nullValues(f, a)
+	}
+
+	choices := make([]int, f.Len())
+	for row := range choices {
+		choices[row] = -1
+		for i := range args {
+			if !nulls[i][row] {
+				choices[row] = i
+				break
+			}
+		}
+	}
+
+	return pick(f, args, choices)
+}
+
+// nullif(value, other) returns null if value equals other, value otherwise.
+func nullif(f qf.QFrame, args []string) (interface{}, error) {
+	t, err := commonType(f, args, false)
+	if err != nil {
+		return nil, err
+	}
+
+	choices := make([]int, f.Len())
+	if t == types.Int || t == types.Float {
+		values, _ := floatValues(f, args[0])
+		others, _ := floatValues(f, args[1])
+		for row := range choices {
+			if values[row] == others[row] {
+				choices[row] = -1
+			}
+		}
+	} else {
+		values, others := stringSlice(f, args[0]), stringSlice(f, args[1])
+		for row := range choices {
+			if values[row] != nil && others[row] != nil && *values[row] == *others[row] {
+				choices[row] = -1
+			}
+		}
+	}
+
+	return pick(f, args[:1], choices)
+}
+
+// is_null(value) returns true for null values.
+func isNull(f qf.QFrame, args []string) (interface{}, error) {
+	return nullValues(f, args[0]), nil
+}
+
+// floatArg returns the values of a numeric argument as floats.
+func floatArg(f qf.QFrame, column string) ([]float64, error) {
+	if t := f.ColumnTypeMap()[column]; t != types.Int && t != types.Float {
+		return nil, fmt.Errorf("expected numeric argument, was %s", t)
+	}
+
+	return floatValues(f, column)
+}
+
+// nullValues returns true for the rows where column is null.
+func nullValues(f qf.QFrame, column string) []bool {
+	result := make([]bool, f.Len())
+	switch f.ColumnTypeMap()[column] {
+	case types.Float:
+		for i, x := range f.MustFloatView(column).Slice() {
+			result[i] = math.IsNaN(x)
+		}
+	case types.String, types.Enum:
+		for i, s := range stringSlice(f, column) {
+			result[i] = s == nil
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,106 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"strings"
+)
+
+// orderBy is an entry in an order_by clause. It is either a column name,
+// prefixed with "-" for descending order, or an object:
+// {"col": column or expression, "desc": true|false, "nulls": "first"|"last"}
+//
+// Expressions use the same syntax as alias expressions. Null values are
+// ordered as if they were larger than all other values unless nulls is given.
+type orderBy struct {
+	Col   interface{} `json:"col"`
+	Desc  bool        `json:"desc"`
+	Nulls string      `json:"nulls"`
+}
+
+func (o *orderBy) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*o = orderByColumn(s)
+		return nil
+	}
+
+	// Type alias to avoid recursing into this function
+	type plainOrderBy orderBy
+	p := plainOrderBy{}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("malformed order_by, expected column name or object, was: %s", string(b))
+	}
+
+	switch p.Col.(type) {
+	case string, []interface{}:
+	default:
+		return fmt.Errorf("invalid col in order_by, expected column name or expression, was: %v", p.Col)
+	}
+
+	if p.Nulls != "" && p.Nulls != "first" && p.Nulls != "last" {
+		return fmt.Errorf("invalid nulls in order_by, expected first or last, was: %s", p.Nulls)
+	}
+
+	*o = orderBy(p)
+	return nil
+}
+
+// orderByColumn creates an orderBy from a column name, optionally prefixed with "-".
+func orderByColumn(s string) orderBy {
+	if strings.HasPrefix(s, "-") {
+		return orderBy{Col: s[1:], Desc: true}
+	}
+
+	return orderBy{Col: s}
+}
+
+func orderByColumns(input []string) []orderBy {
+	result := make([]orderBy, len(input))
+	for i, s := range input {
+		result[i] = orderByColumn(s)
+	}
+
+	return result
+}
+
+func (o orderBy) order(column string) qf.Order {
+	// Null values are larger than all other values in qframe when NullLast
+	// is set, for descending order they are hence first.
+	nullLast := true
+	if o.Nulls != "" {
+		nullLast = (o.Nulls == "last") != o.Desc
+	}
+
+	return qf.Order{Column: column, Reverse: o.Desc, NullLast: nullLast}
+}
+
+// sortWithExpressions sorts f according to orders. Expressions in orders are
+// evaluated into temporary columns that are removed after sorting.
+func sortWithExpressions(f qf.QFrame, orders []orderBy, datasets DatasetFn) qf.QFrame {
+	result := make([]qf.Order, len(orders))
+	exprCols := make([]string, 0)
+	for i, o := range orders {
+		if col, ok := o.Col.(string); ok {
+			result[i] = o.order(col)
+			continue
+		}
+
+		dstCol := fmt.Sprintf("__qocache_order_%d", i)
+		expr, err := parseExpression(o.Col, dstCol)
+		if err != nil {
+			return qf.QFrame{Err: err}
+		}
+
+		f = expr.eval(f, dstCol, datasets)
+		exprCols = append(exprCols, dstCol)
+		result[i] = o.order(dstCol)
+	}
+
+	if f.Err != nil {
+		return f
+	}
+
+	return f.Sort(result...).Drop(exprCols...)
+}
@@ -8,18 +8,89 @@ import (
 	"github.com/tobgu/qframe/filter"
 	"github.com/tobgu/qframe/types"
 	qostrings "github.com/tobgu/qocache/strings"
-	"strings"
 )
 
 type query struct {
 	Select   interface{} `json:"select,omitempty"`
 	Where    interface{} `json:"where,omitempty"`
-	OrderBy  []string    `json:"order_by,omitempty"`
+	Having   interface{} `json:"having,omitempty"`
+	OrderBy  []orderBy   `json:"order_by,omitempty"`
 	GroupBy  []string    `json:"group_by,omitempty"`
 	Distinct []string    `json:"distinct,omitempty"`
 	Offset   int         `json:"offset,omitempty"`
 	Limit    int         `json:"limit,omitempty"`
 	From     *query      `json:"from,omitempty"`
+	Join     *joinClause `json:"join,omitempty"`
+}
+
+// subQuery is a query in the argument of an in filter clause. Unless another
+// dataset is given it is executed on the frame that the clause is applied to.
+// In a query with from or join that is the result of those, not the queried
+// dataset as stored.
+type subQuery struct {
+	query
+	Dataset string `json:"dataset,omitempty"`
+}
+
+// subQueryValues executes the subquery in input and returns the values of
+// the single column in the result.
+func subQueryValues(input map[string]interface{}, f qf.QFrame, datasets DatasetFn) (interface{}, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	sq := subQuery{}
+	if err := json.Unmarshal(b, &sq); err != nil {
+		return nil, fmt.Errorf("malformed subquery: %v, %s", input, err.Error())
+	}
+
+	if sq.Dataset != "" {
+		ok := false
+		if datasets != nil {
+			f, ok = datasets(sq.Dataset)
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("dataset in subquery not found: %s", sq.Dataset)
+		}
+	}
+
+	result := sq.query.query(f, datasets)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+
+	columns := result.Qframe.ColumnNames()
+	if len(columns) != 1 {
+		return nil, fmt.Errorf("subquery must return exactly one column, was: %v", columns)
+	}
+
+	col := columns[0]
+	switch result.Qframe.ColumnTypeMap()[col] {
+	case types.Int:
+		return result.Qframe.MustIntView(col).Slice(), nil
+	case types.Float:
+		return result.Qframe.MustFloatView(col).Slice(), nil
+	case types.Bool:
+		return result.Qframe.MustBoolView(col).Slice(), nil
+	case types.Enum:
+		return nonNullStrings(result.Qframe.MustEnumView(col).Slice()), nil
+	default:
+		return nonNullStrings(result.Qframe.MustStringView(col).Slice()), nil
+	}
+}
+
+// nonNullStrings returns the non null strings in input, nulls
+// never match in an in clause.
+func nonNullStrings(input []*string) []string {
+	result := make([]string, 0, len(input))
+	for _, s := range input {
+		if s != nil {
+			result = append(result, *s)
+		}
+	}
+	return result
 }
 
 type QueryResult struct {
@@ -28,10 +99,102 @@ type QueryResult struct {
 	UnslicedLen int
 }
 
-func unMarshalFilterClauses(input []interface{}) ([]qf.FilterClause, error) {
+// filterColumns returns the names of the columns referenced in the filter
+// clause input, without validating the clause.
+func filterColumns(input interface{}) []string {
+	result := make([]string, 0)
+	clause, ok := input.([]interface{})
+	if !ok || len(clause) < 2 {
+		return result
+	}
+
+	switch clause[0] {
+	case "&", "|", "!":
+		for _, c := range clause[1:] {
+			result = append(result, filterColumns(c)...)
+		}
+	default:
+		for _, x := range clause[1:] {
+			if s, ok := x.(string); ok && !qostrings.IsQuoted(s) {
+				result = append(result, s)
+			}
+		}
+	}
+
+	return result
+}
+
+// filterExpressions replaces expressions used in place of a column name in
+// the comparisons of the filter clause input, eg. ["=", ["cast", "a", "int"], 1]
+// or ["=", "a", ["cast", "b", "int"]], with temporary columns. The argument to
+// in is a list of values, not an expression. It returns the rewritten clause
+// together with the aliases that evaluate the temporary columns.
+func filterExpressions(input interface{}, prefix string, aliases []alias) (interface{}, []alias, error) {
+	clause, ok := input.([]interface{})
+	if !ok || len(clause) < 2 {
+		return input, aliases, nil
+	}
+
+	result := make([]interface{}, len(clause))
+	copy(result, clause)
+	switch clause[0] {
+	case "&", "|", "!":
+		for i, c := range clause[1:] {
+			var err error
+			if result[i+1], aliases, err = filterExpressions(c, prefix, aliases); err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		for i, x := range clause[1:] {
+			if _, ok := x.([]interface{}); !ok || i == 1 && clause[0] == "in" {
+				continue
+			}
+
+			dstCol := fmt.Sprintf("%s__qocache_filter_%d", prefix, len(aliases))
+			expr, err := parseExpression(x, dstCol)
+			if err != nil {
+				return nil, nil, err
+			}
+			aliases = append(aliases, alias{dstCol: dstCol, expr: expr})
+			result[i+1] = dstCol
+		}
+	}
+
+	return result, aliases, nil
+}
+
+// filterWithExpressions applies the filter clause input to f, evaluating any
+// expressions in it as described in filterExpressions. The temporary columns
+// are named after prefix.
+func filterWithExpressions(f qf.QFrame, input interface{}, prefix string, datasets DatasetFn, fn func(qf.FilterClause) qf.FilterClause) qf.QFrame {
+	input, aliases, err := filterExpressions(input, prefix, nil)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	exprCols := make([]string, len(aliases))
+	for i, a := range aliases {
+		f = a.execute(f, datasets)
+		exprCols[i] = a.column()
+	}
+
+	if f.Err != nil {
+		return f
+	}
+
+	clause, err := unMarshalFilterClause(input, f, datasets)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	return f.Filter(fn(clause)).Drop(exprCols...)
+}
+
+func unMarshalFilterClauses(input []interface{}, f qf.QFrame, datasets DatasetFn) ([]qf.FilterClause, error) {
 	result := make([]qf.FilterClause, 0, len(input))
 	for _, x := range input {
-		c, err := unMarshalFilterClause(x)
+		c, err := unMarshalFilterClause(x, f, datasets)
 		if err != nil {
 			return nil, err
 		}
@@ -41,7 +204,9 @@ func unMarshalFilterClauses(input []interface{}) ([]qf.FilterClause, error) {
 	return result, nil
 }
 
-func unMarshalFilterClause(input interface{}) (qf.FilterClause, error) {
+// unMarshalFilterClause creates a filter clause, to be applied to f, from input.
+// f and datasets are used to evaluate any subqueries in the clause.
+func unMarshalFilterClause(input interface{}, f qf.QFrame, datasets DatasetFn) (qf.FilterClause, error) {
 	var c qf.FilterClause = qf.Null()
 	if input == nil {
 		return c, c.Err()
@@ -63,13 +228,13 @@ func unMarshalFilterClause(input interface{}) (qf.FilterClause, error) {
 
 	switch operator {
 	case "&":
-		subClauses, err := unMarshalFilterClauses(clause[1:])
+		subClauses, err := unMarshalFilterClauses(clause[1:], f, datasets)
 		if err != nil {
 			return c, err
 		}
 		c = qf.And(subClauses...)
 	case "|":
-		subClauses, err := unMarshalFilterClauses(clause[1:])
+		subClauses, err := unMarshalFilterClauses(clause[1:], f, datasets)
 		if err != nil {
 			return c, err
 		}
@@ -79,7 +244,7 @@ func unMarshalFilterClause(input interface{}) (qf.FilterClause, error) {
 			return c, fmt.Errorf(`invalid 'not' filter clause length, expected ["!", [...]], was: %v`, clause)
 		}
 
-		subClause, err := unMarshalFilterClause(clause[1])
+		subClause, err := unMarshalFilterClause(clause[1], f, datasets)
 		if err != nil {
 			return c, err
 		}
@@ -98,10 +263,23 @@ func unMarshalFilterClause(input interface{}) (qf.FilterClause, error) {
 
 		if len(clause) == 3 {
 			arg = clause[2]
-			if s, ok := arg.(string); ok {
+			if sq, ok := arg.(map[string]interface{}); ok && operator == "in" {
+				var err error
+				arg, err = subQueryValues(sq, f, datasets)
+				if err != nil {
+					return c, err
+				}
+			} else if s, ok := arg.(string); ok {
 				// Quoted strings are string constants, other strings are column names
 				if qostrings.IsQuoted(s) {
 					arg = qostrings.TrimQuotes(s)
+					if datetimeComparators[operator] && isDatetimeColumn(f, colName) {
+						lit, err := datetimeLiteral(arg.(string))
+						if err != nil {
+							return c, err
+						}
+						arg = lit
+					}
 				} else {
 					arg = types.ColumnName(s)
 				}
@@ -122,12 +300,17 @@ func unMarshalFilterClause(input interface{}) (qf.FilterClause, error) {
 type selectClause struct {
 	columns []string
 	aliases []alias
+	windows []windowExpr
 	aggregations
 }
 
-func (c selectClause) doSelect(f qf.QFrame) qf.QFrame {
+func (c selectClause) doSelect(f qf.QFrame, datasets DatasetFn) qf.QFrame {
 	for _, a := range c.aliases {
-		f = a.execute(f)
+		f = a.execute(f, datasets)
+	}
+
+	for _, w := range c.windows {
+		f = w.execute(f)
 	}
 
 	if len(c.columns) > 0 {
@@ -137,23 +320,113 @@ func (c selectClause) doSelect(f qf.QFrame) qf.QFrame {
 	return f
 }
 
+// withoutAliases returns c without the aliases of columns, and those aliases.
+// This is used to evaluate aliases before filtering and grouping, which allows
+// filtering and grouping by the result of an expression. Aliases that the aliases
+// of columns depend on are included, the aliases are returned in select order.
+func (c selectClause) withoutAliases(columns []string) (selectClause, []alias) {
+	// An alias can only depend on aliases before it in select
+	needed := append([]string{}, columns...)
+	for i := len(c.aliases) - 1; i >= 0; i-- {
+		if a := c.aliases[i]; contains(needed, a.column()) {
+			needed = append(needed, a.columns...)
+		}
+	}
+
+	removed, aliases := make([]alias, 0), make([]alias, 0, len(c.aliases))
+	for _, a := range c.aliases {
+		if contains(needed, a.column()) {
+			removed = append(removed, a)
+		} else {
+			aliases = append(aliases, a)
+		}
+	}
+
+	c.aliases = aliases
+	return c, removed
+}
+
+// without returns strs without s.
+func without(strs []string, s string) []string {
+	result := make([]string, 0, len(strs))
+	for _, x := range strs {
+		if x != s {
+			result = append(result, x)
+		}
+	}
+
+	return result
+}
+
+func contains(strs []string, s string) bool {
+	for _, x := range strs {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
 type alias struct {
 	dstCol string
-	expr   qf.Expression
+	expr   expression
+
+	// The columns referenced in the expression
+	columns []string
 }
 
-func (a alias) execute(f qf.QFrame) qf.QFrame {
-	return f.Eval(a.dstCol, a.expr)
+func (a alias) execute(f qf.QFrame, datasets DatasetFn) qf.QFrame {
+	return a.expr.eval(f, a.dstCol, datasets)
 }
 
 func (a alias) column() string {
 	return a.dstCol
 }
 
-type aggregations []qf.Aggregation
+type aggregation struct {
+	qf.Aggregation
 
-func (as aggregations) Execute(grouper qf.Grouper) qf.QFrame {
-	return grouper.Aggregate(as...)
+	// Arguments to custom aggregations
+	args []interface{}
+}
+
+type aggregations []aggregation
+
+// Execute applies the aggregations to the groups in f given by groupBy.
+func (as aggregations) Execute(f qf.QFrame, groupBy []string) qf.QFrame {
+	const rowCountCol = "__qocache_row_count"
+	aggs := make([]qf.Aggregation, len(as))
+	for i, a := range as {
+		if a.Column == "" {
+			// Row count, counted on a column of its own since the existing ones
+			// may be used for grouping
+			if _, ok := f.ColumnTypeMap()[rowCountCol]; !ok {
+				f = f.WithRowNums(rowCountCol)
+			}
+			a.Column = rowCountCol
+		} else if _, ok := f.ColumnTypeMap()[a.Column]; !ok {
+			return qf.QFrame{Err: fmt.Errorf("unknown column in aggregation: %s", a.Column)}
+		}
+
+		if fn, ok := lookupAggregation(a.Fn.(string)); ok {
+			var err error
+			if f, a.Aggregation, err = customAggregation(f, a, fn, i); err != nil {
+				return qf.QFrame{Err: err}
+			}
+		}
+		aggs[i] = a.Aggregation
+	}
+
+	return f.GroupBy(groupby.Columns(groupBy...)).Aggregate(aggs...)
+}
+
+// aggregationColumn returns the name of the column holding the result of a.
+func aggregationColumn(a qf.Aggregation) string {
+	if a.As != "" {
+		return a.As
+	}
+	return a.Column
 }
 
 func unMarshalSelectClause(input interface{}) (selectClause, error) {
@@ -170,10 +443,11 @@ func unMarshalSelectClause(input interface{}) (selectClause, error) {
 	columns := make([]string, 0, len(inputSlice))
 	aggregations := make(aggregations, 0)
 	aliases := make([]alias, 0)
+	windows := make([]windowExpr, 0)
 	for _, part := range inputSlice {
 		switch p := part.(type) {
 		case []interface{}:
-			if len(p) < 2 {
+			if len(p) < 1 {
 				return emptySelect, fmt.Errorf("malformed expression in select, too short: %v", p)
 			}
 
@@ -197,8 +471,15 @@ func unMarshalSelectClause(input interface{}) (selectClause, error) {
 					return emptySelect, err
 				}
 				aggregations = append(aggregations, a)
-				columns = append(columns, a.Column)
+				columns = append(columns, aggregationColumn(a.Aggregation))
 			}
+		case map[string]interface{}:
+			w, err := createWindow(p)
+			if err != nil {
+				return emptySelect, err
+			}
+			windows = append(windows, w)
+			columns = append(columns, w.column())
 		case string:
 			columns = append(columns, p)
 		default:
@@ -206,7 +487,7 @@ func unMarshalSelectClause(input interface{}) (selectClause, error) {
 		}
 	}
 
-	return selectClause{columns: columns, aggregations: aggregations, aliases: aliases}, nil
+	return selectClause{columns: columns, aggregations: aggregations, aliases: aliases, windows: windows}, nil
 }
 
 // Takes an alias expression as parsed from JSON and transforms it into a data
@@ -245,15 +526,24 @@ func createAlias(aliasExpr []interface{}) (alias, error) {
 		return alias{}, fmt.Errorf("invalid alias destination column, was: %v", aliasExpr[0])
 	}
 
-	prepareAlias(&aliasExpr[1])
-	expr := qf.Val(aliasExpr[1])
-	return alias{dstCol: dstCol, expr: expr}, expr.Err()
+	// Parsing the expression modifies it, the columns have to be collected first
+	columns := expressionColumns(aliasExpr[1])
+	expr, err := parseExpression(aliasExpr[1], dstCol)
+	return alias{dstCol: dstCol, expr: expr, columns: columns}, err
 }
 
-func createAggregation(expr []interface{}) (qf.Aggregation, error) {
-	noAgg := qf.Aggregation{}
-	if len(expr) != 2 {
-		return noAgg, fmt.Errorf("invalid aggregation expression, expected length 2, was: %v", expr)
+// createAggregation creates an aggregation from one of the forms [fn, column] or
+// [fn, column, alias]. Without an alias the result is stored in the aggregated
+// column, with an alias in a new column which allows multiple aggregations of
+// the same column. The number of rows can be counted using ["count"], the
+// result is stored in the column "count" unless a column name is given.
+//
+// Custom aggregations, see RegisterAggregation, may take additional arguments
+// after the alias, [fn, column, alias, args...]. The alias may be null.
+func createAggregation(expr []interface{}) (aggregation, error) {
+	noAgg := aggregation{}
+	if len(expr) < 1 {
+		return noAgg, fmt.Errorf(`invalid aggregation expression, expected ["count"] or [function, column, alias, args...] with alias and args optional, was: %v`, expr)
 	}
 
 	aggFn, ok := expr[0].(string)
@@ -261,25 +551,41 @@ func createAggregation(expr []interface{}) (qf.Aggregation, error) {
 		return noAgg, fmt.Errorf("aggregation function name must be a string, was: %v", expr[0])
 	}
 
-	aggCol, ok := expr[1].(string)
+	if aggFn == "count" && (len(expr) == 1 || len(expr) == 3 && expr[1] == nil) {
+		// Count of rows, not tied to any column, named "count" unless an alias is given
+		result := aggregation{Aggregation: qf.Aggregation{Fn: aggFn, As: "count"}}
+		if len(expr) == 3 {
+			if result.As, ok = expr[2].(string); !ok {
+				return noAgg, fmt.Errorf("aggregation column name and alias must be strings, was: %v", expr[2])
+			}
+		}
+		return result, nil
+	}
+
+	if len(expr) < 2 {
+		return noAgg, fmt.Errorf(`invalid aggregation expression, expected ["count"] or [function, column, alias, args...] with alias and args optional, was: %v`, expr)
+	}
+
+	column, ok := expr[1].(string)
 	if !ok {
-		return noAgg, fmt.Errorf("aggregation column name must be a string, was: %v", expr[1])
+		return noAgg, fmt.Errorf("aggregation column name and alias must be strings, was: %v", expr[1])
 	}
 
-	return qf.Aggregation{Fn: aggFn, Column: aggCol}, nil
-}
+	result := aggregation{Aggregation: qf.Aggregation{Fn: aggFn, Column: column}}
+	if len(expr) > 2 && expr[2] != nil {
+		if result.As, ok = expr[2].(string); !ok {
+			return noAgg, fmt.Errorf("aggregation column name and alias must be strings, was: %v", expr[2])
+		}
+	}
 
-func unMarshalOrderByClause(input []string) []qf.Order {
-	result := make([]qf.Order, len(input))
-	for i, s := range input {
-		if strings.HasPrefix(s, "-") {
-			result[i] = qf.Order{Column: s[1:], Reverse: true, NullLast: true}
-		} else {
-			result[i] = qf.Order{Column: s, Reverse: false, NullLast: true}
+	if len(expr) > 3 {
+		if _, ok := lookupAggregation(aggFn); !ok {
+			return noAgg, fmt.Errorf("aggregation %s does not take any arguments, was: %v", aggFn, expr)
 		}
+		result.args = expr[3:]
 	}
 
-	return result
+	return result, nil
 }
 
 func newQuery(qString string) (query, error) {
@@ -288,13 +594,51 @@ func newQuery(qString string) (query, error) {
 	return q, err
 }
 
-func Query(f qf.QFrame, qString string) QueryResult {
+// Query executes the query in qString on f. datasets is used to look up
+// any other datasets referenced by the query, it may be nil.
+func Query(f qf.QFrame, qString string, datasets DatasetFn) QueryResult {
 	q, err := newQuery(qString)
 	if err != nil {
 		return QueryResult{Err: err}
 	}
 
-	return q.query(f)
+	return q.query(f, datasets)
+}
+
+type DeleteResult struct {
+	Qframe       qf.QFrame
+	Err          error
+	DeletedCount int
+}
+
+type deleteQuery struct {
+	Where interface{} `json:"where"`
+}
+
+// Delete removes the rows in f that match the where clause in qString,
+// eg. {"where": ["<", "a", 1]}. A where clause is required, an empty clause
+// would remove all rows. datasets is used to look up any other datasets
+// referenced by subqueries, it may be nil.
+func Delete(f qf.QFrame, qString string, datasets DatasetFn) DeleteResult {
+	q := deleteQuery{}
+	if err := json.Unmarshal([]byte(qString), &q); err != nil {
+		return DeleteResult{Err: err}
+	}
+
+	if q.Where == nil {
+		return DeleteResult{Err: fmt.Errorf("missing where clause in delete")}
+	}
+
+	// Not applied directly to a comparison inverts the comparator which would not
+	// keep rows with null values, wrapping it in And gives the exact complement.
+	newF := filterWithExpressions(f, q.Where, "", datasets, func(c qf.FilterClause) qf.FilterClause {
+		return qf.Not(qf.And(c))
+	})
+	if newF.Err != nil {
+		return DeleteResult{Err: newF.Err}
+	}
+
+	return DeleteResult{Qframe: newF, Err: newF.Err, DeletedCount: f.Len() - newF.Len()}
 }
 
 func intMin(x, y int) int {
@@ -329,16 +673,23 @@ func (q query) slice(f qf.QFrame) qf.QFrame {
 	return f.Slice(offset, stop)
 }
 
-func (q query) query(f qf.QFrame) QueryResult {
+func (q query) query(f qf.QFrame, datasets DatasetFn) QueryResult {
 	var err error
 	if q.From != nil {
-		result := q.From.query(f)
+		result := q.From.query(f, datasets)
 		if result.Err != nil {
 			return result
 		}
 		f = result.Qframe
 	}
 
+	if q.Join != nil {
+		f = q.Join.join(f, datasets)
+		if f.Err != nil {
+			return QueryResult{Err: f.Err}
+		}
+	}
+
 	if len(q.GroupBy) > 0 && len(q.Distinct) > 0 {
 		// Don'ẗ really know what this combination would mean at the moment
 		// therefor it is currently banned.
@@ -346,28 +697,57 @@ func (q query) query(f qf.QFrame) QueryResult {
 		return QueryResult{Err: fmt.Errorf("cannot combine group by and distinct in the same query")}
 	}
 
-	filterClause, err := unMarshalFilterClause(q.Where)
+	selectClause, err := unMarshalSelectClause(q.Select)
 	if err != nil {
 		return QueryResult{Err: err}
 	}
 
-	selectClause, err := unMarshalSelectClause(q.Select)
-	if err != nil {
-		return QueryResult{Err: err}
+	// Columns in the where clause that do not exist in f may be derived
+	// from expressions in select.
+	derivedColumns := make([]string, 0)
+	for _, col := range filterColumns(q.Where) {
+		if !f.Contains(col) {
+			derivedColumns = append(derivedColumns, col)
+		}
 	}
 
-	newF := f.Filter(filterClause)
-	if len(q.GroupBy) > 0 || len(selectClause.aggregations) > 0 {
-		grouper := newF.GroupBy(groupby.Columns(q.GroupBy...))
-		newF = selectClause.aggregations.Execute(grouper)
+	var whereAliases []alias
+	selectClause, whereAliases = selectClause.withoutAliases(derivedColumns)
+	for _, a := range whereAliases {
+		f = a.execute(f, datasets)
+	}
+
+	isAggregation := len(q.GroupBy) > 0 || len(selectClause.aggregations) > 0
+	if q.Having != nil && !isAggregation {
+		return QueryResult{Err: fmt.Errorf("having requires group_by or aggregations in select")}
+	}
+
+	newF := filterWithExpressions(f, q.Where, "", datasets, func(c qf.FilterClause) qf.FilterClause { return c })
+	if newF.Err != nil {
+		return QueryResult{Err: newF.Err}
+	}
+
+	if isAggregation {
+		var groupAliases []alias
+		selectClause, groupAliases = selectClause.withoutAliases(q.GroupBy)
+		for _, a := range groupAliases {
+			newF = a.execute(newF, datasets)
+			if !contains(q.GroupBy, a.column()) {
+				// Only needed to evaluate other aliases in group by, gone after aggregation
+				selectClause.columns = without(selectClause.columns, a.column())
+			}
+		}
+
+		newF = selectClause.aggregations.Execute(newF, q.GroupBy)
+		newF = filterWithExpressions(newF, q.Having, "", datasets, func(c qf.FilterClause) qf.FilterClause { return c })
 	}
 
 	if q.Distinct != nil {
 		newF = newF.Distinct(groupby.Columns(q.Distinct...))
 	}
 
-	newF = newF.Sort(unMarshalOrderByClause(q.OrderBy)...)
-	newF = selectClause.doSelect(newF)
+	newF = sortWithExpressions(newF, q.OrderBy, datasets)
+	newF = selectClause.doSelect(newF, datasets)
 	unslicedLen := newF.Len()
 	newF = q.slice(newF)
 	return QueryResult{Qframe: newF, UnslicedLen: unslicedLen, Err: newF.Err}
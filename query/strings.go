@@ -0,0 +1,195 @@
+package query
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"strings"
+)
+
+// String functions in alias expressions. They follow the semantics of the
+// PostgreSQL functions with the same names, positions are 1-based and
+// null input results in null output.
+
+// mapStrings applies fn to the non null values of the string argument col.
+func mapStrings(f qf.QFrame, col string, fn func(i int, s string) (string, error)) ([]*string, error) {
+	values, err := stringArg(f, col)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*string, len(values))
+	for i, s := range values {
+		if s == nil {
+			continue
+		}
+
+		r, err := fn(i, *s)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = &r
+	}
+
+	return result, nil
+}
+
+// optionalArg returns the i:th argument or nil if there are not that many arguments.
+func optionalArg(args []string, i int) *string {
+	if i < len(args) {
+		return &args[i]
+	}
+
+	return nil
+}
+
+// substr(string, start[, length])
+func substr(f qf.QFrame, args []string) (interface{}, error) {
+	starts, err := intArg(f, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	var lengths []int
+	if lengthCol := optionalArg(args, 2); lengthCol != nil {
+		if lengths, err = intArg(f, *lengthCol); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapStrings(f, args[0], func(i int, s string) (string, error) {
+		runes := []rune(s)
+		begin, end := starts[i]-1, len(runes)
+		if lengths != nil {
+			if lengths[i] < 0 {
+				return "", fmt.Errorf("negative substring length: %d", lengths[i])
+			}
+			end = intMin(begin+lengths[i], end)
+		}
+
+		begin = intMax(begin, 0)
+		if end <= begin {
+			return "", nil
+		}
+		return string(runes[begin:end]), nil
+	})
+}
+
+// concat(value, ...) concatenates values of any type, null values are ignored.
+func concat(f qf.QFrame, args []string) (interface{}, error) {
+	values := make([][]*string, len(args))
+	for i, a := range args {
+		values[i] = anyStringArg(f, a)
+	}
+
+	result := make([]*string, f.Len())
+	for i := range result {
+		b := strings.Builder{}
+		for _, v := range values {
+			if v[i] != nil {
+				b.WriteString(*v[i])
+			}
+		}
+		s := b.String()
+		result[i] = &s
+	}
+
+	return result, nil
+}
+
+// trim(string[, characters]) removes whitespace, or the given characters,
+// from the start and end of string.
+func trim(f qf.QFrame, args []string) (interface{}, error) {
+	var chars []*string
+	if charsCol := optionalArg(args, 1); charsCol != nil {
+		var err error
+		if chars, err = stringArg(f, *charsCol); err != nil {
+			return nil, err
+		}
+	}
+
+	return mapStrings(f, args[0], func(i int, s string) (string, error) {
+		if chars == nil {
+			return strings.TrimSpace(s), nil
+		}
+
+		if chars[i] == nil {
+			return s, nil
+		}
+		return strings.Trim(s, *chars[i]), nil
+	})
+}
+
+// length(string) returns the number of characters in string.
+func length(f qf.QFrame, args []string) (interface{}, error) {
+	values, err := stringArg(f, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	result, nulls := make([]int, len(values)), make([]bool, len(values))
+	for i, s := range values {
+		if s == nil {
+			nulls[i] = true
+		} else {
+			result[i] = len([]rune(*s))
+		}
+	}
+
+	return intsOrFloats(result, nulls), nil
+}
+
+// replace(string, from, to) replaces all occurrences of from in string with to.
+func replace(f qf.QFrame, args []string) (interface{}, error) {
+	froms, err := stringArg(f, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	tos, err := stringArg(f, args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return mapStrings(f, args[0], func(i int, s string) (string, error) {
+		if froms[i] == nil || tos[i] == nil || *froms[i] == "" {
+			return s, nil
+		}
+		return strings.ReplaceAll(s, *froms[i], *tos[i]), nil
+	})
+}
+
+// split_part(string, delimiter, n) splits string on delimiter and returns the
+// n:th part, counting from the end if n is negative. Returns an empty string
+// if there is no such part.
+func splitPart(f qf.QFrame, args []string) (interface{}, error) {
+	delimiters, err := stringArg(f, args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	ns, err := intArg(f, args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return mapStrings(f, args[0], func(i int, s string) (string, error) {
+		n := ns[i]
+		if n == 0 {
+			return "", fmt.Errorf("field position must not be zero")
+		}
+
+		parts := []string{s}
+		if delimiters[i] != nil && *delimiters[i] != "" {
+			parts = strings.Split(s, *delimiters[i])
+		}
+
+		if n < 0 {
+			n = len(parts) + n + 1
+		}
+
+		if n < 1 || n > len(parts) {
+			return "", nil
+		}
+		return parts[n-1], nil
+	})
+}
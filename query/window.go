@@ -0,0 +1,489 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"github.com/tobgu/qocache/storage"
+	"math"
+	"strings"
+)
+
+const windowRowNumColumn = "__qocache_window_row_num"
+
+// windowExpr is a window function in select, eg:
+// {"window": "sum", "column": "price", "as": "running_total", "partition_by": ["item"],
+// "order_by": ["date"], "frame": [null, 0]}
+//
+// The function is evaluated per partition, with rows ordered by order_by, and the
+// result is stored in a new column. The number of rows is not changed.
+type windowExpr struct {
+	Fn          string   `json:"window"`
+	Column      string   `json:"column"`
+	As          string   `json:"as"`
+	PartitionBy []string `json:"partition_by"`
+	OrderBy     []string `json:"order_by"`
+
+	// Rows included in aggregations relative to the current row, [start, end].
+	// null means unbounded. Defaults to all rows up to the current row if
+	// order_by is given, all rows in the partition otherwise.
+	Frame []*int `json:"frame"`
+
+	// Number of rows to look back or ahead for lag and lead, defaults to 1.
+	Offset *int `json:"offset"`
+}
+
+var windowFns = map[string]struct {
+	needsColumn  bool
+	needsOrderBy bool
+	hasFrame     bool
+}{
+	"row_number": {needsOrderBy: false},
+	"rank":       {needsOrderBy: true},
+	"dense_rank": {needsOrderBy: true},
+	"lag":        {needsColumn: true},
+	"lead":       {needsColumn: true},
+	"sum":        {needsColumn: true, hasFrame: true},
+	"mean":       {needsColumn: true, hasFrame: true},
+	"min":        {needsColumn: true, hasFrame: true},
+	"max":        {needsColumn: true, hasFrame: true},
+	"count":      {hasFrame: true},
+}
+
+func createWindow(input map[string]interface{}) (windowExpr, error) {
+	b, err := json.Marshal(input)
+	if err != nil {
+		return windowExpr{}, err
+	}
+
+	w := windowExpr{}
+	if err := json.Unmarshal(b, &w); err != nil {
+		return w, fmt.Errorf("malformed window expression: %v, %s", input, err.Error())
+	}
+
+	spec, ok := windowFns[w.Fn]
+	if !ok {
+		return w, fmt.Errorf("unknown window function: %s", w.Fn)
+	}
+
+	if w.As == "" {
+		return w, fmt.Errorf("missing destination column, as, in window expression: %v", input)
+	}
+
+	if spec.needsColumn && w.Column == "" {
+		return w, fmt.Errorf("window function %s requires a column", w.Fn)
+	}
+
+	if spec.needsOrderBy && len(w.OrderBy) == 0 {
+		return w, fmt.Errorf("window function %s requires order_by", w.Fn)
+	}
+
+	if w.Frame != nil {
+		if !spec.hasFrame {
+			return w, fmt.Errorf("frame not supported by window function %s", w.Fn)
+		}
+
+		if len(w.Frame) != 2 {
+			return w, fmt.Errorf("invalid window frame, expected [start, end], was: %v", input["frame"])
+		}
+
+		if w.Frame[0] != nil && w.Frame[1] != nil && *w.Frame[0] > *w.Frame[1] {
+			return w, fmt.Errorf("invalid window frame, start after end: %v", input["frame"])
+		}
+	} else if len(w.OrderBy) > 0 {
+		zero := 0
+		w.Frame = []*int{nil, &zero}
+	} else {
+		w.Frame = []*int{nil, nil}
+	}
+
+	if w.Offset == nil {
+		one := 1
+		w.Offset = &one
+	}
+
+	return w, nil
+}
+
+func (w windowExpr) column() string {
+	return w.As
+}
+
+// partitions returns the [start, end) ranges of the partitions in sorted.
+func (w windowExpr) partitions(sorted qf.QFrame) ([][2]int, error) {
+	n := sorted.Len()
+	if len(w.PartitionBy) == 0 {
+		return [][2]int{{0, n}}, nil
+	}
+
+	keys, _, err := storage.RowKeys(sorted, w.PartitionBy)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([][2]int, 0)
+	start := 0
+	for i := 1; i <= n; i++ {
+		if i == n || keys[i] != keys[start] {
+			result = append(result, [2]int{start, i})
+			start = i
+		}
+	}
+
+	return result, nil
+}
+
+func (w windowExpr) execute(f qf.QFrame) qf.QFrame {
+	if f.Err != nil {
+		return f
+	}
+
+	orders := make([]string, 0, len(w.PartitionBy)+len(w.OrderBy))
+	orders = append(orders, w.PartitionBy...)
+	orders = append(orders, w.OrderBy...)
+	sorted := sortWithExpressions(f.WithRowNums(windowRowNumColumn), orderByColumns(orders), nil)
+	if sorted.Err != nil {
+		return sorted
+	}
+
+	partitions, err := w.partitions(sorted)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	var result interface{}
+	switch w.Fn {
+	case "row_number", "rank", "dense_rank":
+		result, err = w.ranks(sorted, partitions)
+	case "lag", "lead":
+		result, err = w.shift(sorted, partitions)
+	default:
+		result, err = w.aggregate(sorted, partitions)
+	}
+
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	// Results are in sorted order, move them back to the original order
+	rowNums := sorted.MustIntView(windowRowNumColumn).Slice()
+	switch r := result.(type) {
+	case []int:
+		values := make([]int, len(r))
+		for k, rowNum := range rowNums {
+			values[rowNum] = r[k]
+		}
+		result = values
+	case []float64:
+		values := make([]float64, len(r))
+		for k, rowNum := range rowNums {
+			values[rowNum] = r[k]
+		}
+		result = values
+	case []*string:
+		values := make([]*string, len(r))
+		for k, rowNum := range rowNums {
+			values[rowNum] = r[k]
+		}
+		result = values
+	}
+
+	return withColumn(f, w.As, result)
+}
+
+func (w windowExpr) ranks(sorted qf.QFrame, partitions [][2]int) ([]int, error) {
+	result := make([]int, sorted.Len())
+	var orderKeys []string
+	if w.Fn != "row_number" {
+		orderColumns := make([]string, len(w.OrderBy))
+		for i, c := range w.OrderBy {
+			orderColumns[i] = strings.TrimPrefix(c, "-")
+		}
+
+		var err error
+		if orderKeys, _, err = storage.RowKeys(sorted, orderColumns); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range partitions {
+		rank := 0
+		for k := p[0]; k < p[1]; k++ {
+			switch {
+			case w.Fn == "row_number":
+				rank = k - p[0] + 1
+			case k > p[0] && orderKeys[k] == orderKeys[k-1]:
+				// Tie, same rank as the previous row
+			case w.Fn == "rank":
+				rank = k - p[0] + 1
+			default:
+				// dense_rank
+				rank++
+			}
+			result[k] = rank
+		}
+	}
+
+	return result, nil
+}
+
+// shift implements lag and lead. Int columns are converted to float columns
+// since rows before the first and after the last row are null.
+func (w windowExpr) shift(sorted qf.QFrame, partitions [][2]int) (interface{}, error) {
+	offset := *w.Offset
+	if w.Fn == "lag" {
+		offset = -offset
+	}
+
+	source := func(k int, p [2]int) (int, bool) {
+		j := k + offset
+		return j, j >= p[0] && j < p[1]
+	}
+
+	switch sorted.ColumnTypeMap()[w.Column] {
+	case types.Int, types.Float:
+		values, err := floatValues(sorted, w.Column)
+		if err != nil {
+			return nil, err
+		}
+
+		result := make([]float64, len(values))
+		for _, p := range partitions {
+			for k := p[0]; k < p[1]; k++ {
+				result[k] = math.NaN()
+				if j, ok := source(k, p); ok {
+					result[k] = values[j]
+				}
+			}
+		}
+		return result, nil
+	case types.String, types.Enum:
+		var values []*string
+		if view, err := sorted.StringView(w.Column); err == nil {
+			values = view.Slice()
+		} else {
+			values = sorted.MustEnumView(w.Column).Slice()
+		}
+
+		result := make([]*string, len(values))
+		for _, p := range partitions {
+			for k := p[0]; k < p[1]; k++ {
+				if j, ok := source(k, p); ok {
+					result[k] = values[j]
+				}
+			}
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("window function %s not supported for column %s", w.Fn, w.Column)
+	}
+}
+
+func floatValues(f qf.QFrame, column string) ([]float64, error) {
+	switch f.ColumnTypeMap()[column] {
+	case types.Int:
+		ints := f.MustIntView(column).Slice()
+		result := make([]float64, len(ints))
+		for i, x := range ints {
+			result[i] = float64(x)
+		}
+		return result, nil
+	case types.Float:
+		return f.MustFloatView(column).Slice(), nil
+	default:
+		return nil, fmt.Errorf("window functions sum, mean, min and max require a numeric column, %s is not", column)
+	}
+}
+
+// bounds returns the first and last row of the frame of row k in partition p.
+// The frame is empty if first > last.
+func (w windowExpr) bounds(k int, p [2]int) (int, int) {
+	first, last := p[0], p[1]-1
+	if w.Frame[0] != nil {
+		first = intMax(first, k+*w.Frame[0])
+	}
+
+	if w.Frame[1] != nil {
+		last = intMin(last, k+*w.Frame[1])
+	}
+
+	return first, last
+}
+
+// aggregate implements the aggregating window functions. Null values are
+// ignored. The result of sum over int columns and count are ints, all other
+// results are floats.
+func (w windowExpr) aggregate(sorted qf.QFrame, partitions [][2]int) (interface{}, error) {
+	n := sorted.Len()
+	if w.Fn == "count" && w.Column == "" {
+		result := make([]int, n)
+		for _, p := range partitions {
+			for k := p[0]; k < p[1]; k++ {
+				first, last := w.bounds(k, p)
+				result[k] = intMax(last-first+1, 0)
+			}
+		}
+		return result, nil
+	}
+
+	var values []float64
+	var err error
+	if w.Fn == "count" {
+		values, err = nullMarkers(sorted, w.Column)
+	} else {
+		values, err = floatValues(sorted, w.Column)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefix sums and counts make sums, means and counts over any frame O(1)
+	sums, counts := make([]float64, n+1), make([]int, n+1)
+	for i, v := range values {
+		sums[i+1], counts[i+1] = sums[i], counts[i]
+		if !math.IsNaN(v) {
+			sums[i+1] += v
+			counts[i+1]++
+		}
+	}
+
+	isInt := sorted.ColumnTypeMap()[w.Column] == types.Int
+	intResult, floatResult := make([]int, n), make([]float64, n)
+	var extremes []float64
+	if w.Fn == "min" || w.Fn == "max" {
+		extremes = make([]float64, n)
+	}
+
+	for _, p := range partitions {
+		if extremes != nil {
+			w.runningExtremes(values, extremes, p)
+		}
+
+		for k := p[0]; k < p[1]; k++ {
+			first, last := w.bounds(k, p)
+			count, sum := 0, 0.0
+			if first <= last {
+				count, sum = counts[last+1]-counts[first], sums[last+1]-sums[first]
+			}
+
+			switch w.Fn {
+			case "count":
+				intResult[k] = count
+			case "sum":
+				intResult[k], floatResult[k] = int(sum), sum
+			case "mean":
+				floatResult[k] = math.NaN()
+				if count > 0 {
+					floatResult[k] = sum / float64(count)
+				}
+			default:
+				floatResult[k] = w.extreme(values, extremes, first, last, p)
+			}
+		}
+	}
+
+	if w.Fn == "count" || (w.Fn == "sum" && isInt) {
+		return intResult, nil
+	}
+
+	return floatResult, nil
+}
+
+// nullMarkers returns a slice with NaN for null values in column and 0 otherwise.
+func nullMarkers(f qf.QFrame, column string) ([]float64, error) {
+	result := make([]float64, f.Len())
+	switch f.ColumnTypeMap()[column] {
+	case types.Float:
+		for i, v := range f.MustFloatView(column).Slice() {
+			if math.IsNaN(v) {
+				result[i] = math.NaN()
+			}
+		}
+	case types.String:
+		for i, v := range f.MustStringView(column).Slice() {
+			if v == nil {
+				result[i] = math.NaN()
+			}
+		}
+	case types.Enum:
+		for i, v := range f.MustEnumView(column).Slice() {
+			if v == nil {
+				result[i] = math.NaN()
+			}
+		}
+	case types.Int, types.Bool:
+		// Never null
+	default:
+		return nil, fmt.Errorf("unknown column: %s", column)
+	}
+
+	return result, nil
+}
+
+func (w windowExpr) better(x, y float64) bool {
+	if math.IsNaN(y) {
+		return !math.IsNaN(x)
+	}
+
+	if w.Fn == "min" {
+		return x < y
+	}
+	return x > y
+}
+
+// runningExtremes stores the min or max, depending on the function, of the values
+// from the start of partition p to each row in p in result if the frame is unbounded
+// at the start, from each row to the end of p if the frame is only unbounded at the
+// end. Rows outside of p in result are left untouched.
+func (w windowExpr) runningExtremes(values, result []float64, p [2]int) {
+	if w.Frame[0] == nil {
+		current := math.NaN()
+		for k := p[0]; k < p[1]; k++ {
+			if w.better(values[k], current) {
+				current = values[k]
+			}
+			result[k] = current
+		}
+	} else if w.Frame[1] == nil {
+		current := math.NaN()
+		for k := p[1] - 1; k >= p[0]; k-- {
+			if w.better(values[k], current) {
+				current = values[k]
+			}
+			result[k] = current
+		}
+	}
+}
+
+func (w windowExpr) extreme(values, extremes []float64, first, last int, p [2]int) float64 {
+	if first > last {
+		return math.NaN()
+	}
+
+	if w.Frame[0] == nil {
+		return extremes[last]
+	}
+
+	if w.Frame[1] == nil {
+		return extremes[first]
+	}
+
+	current := math.NaN()
+	for k := first; k <= last; k++ {
+		if w.better(values[k], current) {
+			current = values[k]
+		}
+	}
+
+	return current
+}
+
+func intMax(x, y int) int {
+	if x > y {
+		return x
+	}
+
+	return y
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/tobgu/qocache/cache"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,14 +14,30 @@ type statCtxKey string
 
 const statCtxKeyStats statCtxKey = "stats"
 
-// Statistics is a global statistics collection object. Currently protected by a single
-// mutex. Shard mutex if this ever becomes a point of contention.
+// Statistics is a global statistics collection object. Probes register their data in
+// one of several shards, each protected by its own mutex, to avoid contention between
+// concurrent requests. The shards are merged when the statistics are read.
 type Statistics struct {
-	cache      *cache.LruCache
+	cache      cache.Cache
+	bufferSize int
+	shards     []statisticsShard
+	nextShard  uint32
+
+	// lock serializes reads of the statistics, it protects dataSince
+	lock      *sync.Mutex
+	dataSince time.Time
+}
+
+type statisticsShard struct {
+	lock       sync.Mutex
 	bufferSize int
-	lock       *sync.Mutex
 	data       StatisticsData
-	dataSince  time.Time
+}
+
+// shard returns the shard to register the data of the next probe in.
+// The shards are used round robin to spread the data evenly.
+func (s *Statistics) shard() *statisticsShard {
+	return &s.shards[atomic.AddUint32(&s.nextShard, 1)%uint32(len(s.shards))]
 }
 
 type probe interface {
@@ -57,17 +74,18 @@ func (sp *QueryProbe) Missing() {
 }
 
 func (sp *QueryProbe) register(stats *Statistics, totalDuration float64) {
-	stats.lock.Lock()
+	shard := stats.shard()
+	shard.lock.Lock()
 	if sp.isHit {
-		stats.data.HitCount++
-		if stats.sizeOkF(stats.data.QueryDurations) {
-			stats.data.QueryDurations = append(stats.data.QueryDurations, sp.stopTime.Sub(sp.startTime).Seconds())
-			stats.data.TotalQueryDurations = append(stats.data.TotalQueryDurations, totalDuration)
+		shard.data.HitCount++
+		if shard.sizeOkF(shard.data.QueryDurations) {
+			shard.data.QueryDurations = append(shard.data.QueryDurations, sp.stopTime.Sub(sp.startTime).Seconds())
+			shard.data.TotalQueryDurations = append(shard.data.TotalQueryDurations, totalDuration)
 		}
 	} else {
-		stats.data.MissCount++
+		shard.data.MissCount++
 	}
-	stats.lock.Unlock()
+	shard.lock.Unlock()
 }
 
 func NewQueryProbe(ctx context.Context) *QueryProbe {
@@ -92,14 +110,15 @@ func (sp *StoreProbe) Success(rowCount int) {
 
 func (sp *StoreProbe) register(stats *Statistics, totalDuration float64) {
 	if sp.success {
-		stats.lock.Lock()
-		stats.data.StoreCount++
-		if stats.sizeOkF(stats.data.StoreDurations) {
-			stats.data.StoreDurations = append(stats.data.StoreDurations, sp.stopTime.Sub(sp.startTime).Seconds())
-			stats.data.TotalStoreDurations = append(stats.data.TotalStoreDurations, totalDuration)
-			stats.data.StoreRowCounts = append(stats.data.StoreRowCounts, sp.rowCount)
+		shard := stats.shard()
+		shard.lock.Lock()
+		shard.data.StoreCount++
+		if shard.sizeOkF(shard.data.StoreDurations) {
+			shard.data.StoreDurations = append(shard.data.StoreDurations, sp.stopTime.Sub(sp.startTime).Seconds())
+			shard.data.TotalStoreDurations = append(shard.data.TotalStoreDurations, totalDuration)
+			shard.data.StoreRowCounts = append(shard.data.StoreRowCounts, sp.rowCount)
 		}
-		stats.lock.Unlock()
+		shard.lock.Unlock()
 	}
 }
 
@@ -109,15 +128,26 @@ func NewStoreProbe(ctx context.Context) *StoreProbe {
 	return p
 }
 
-func New(cache *cache.LruCache, bufferSize int) *Statistics {
+// New creates statistics for cache. bufferSize is the maximum number of
+// durations and row counts of each kind kept between reads of the statistics.
+func New(cache cache.Cache, bufferSize int) *Statistics {
+	// The buffer is split evenly between the shards, rounded up
+	shards := make([]statisticsShard, runtime.GOMAXPROCS(0))
+	shardBufferSize := (bufferSize + len(shards) - 1) / len(shards)
+	for i := range shards {
+		shards[i].bufferSize = shardBufferSize
+		shards[i].data = newStatisticsData(shardBufferSize)
+	}
+
 	return &Statistics{
 		lock:       &sync.Mutex{},
-		data:       newStatisticsData(bufferSize),
+		shards:     shards,
 		dataSince:  time.Now(),
 		bufferSize: bufferSize,
 		cache:      cache,
 	}
 }
+
 func newStatisticsData(bufferSize int) StatisticsData {
 	return StatisticsData{
 		StoreDurations:         make([]float64, 0, bufferSize),
@@ -129,10 +159,20 @@ func newStatisticsData(bufferSize int) StatisticsData {
 	}
 }
 
-func (s *Statistics) sizeOkF(x []float64) bool {
+func (s *statisticsShard) sizeOkF(x []float64) bool {
 	return len(x) < s.bufferSize
 }
 
+// take returns the data in the shard and resets it.
+func (s *statisticsShard) take() StatisticsData {
+	newData := newStatisticsData(s.bufferSize)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data := s.data
+	s.data = newData
+	return data
+}
+
 func (s *Statistics) Init(ctx context.Context) context.Context {
 	return context.WithValue(ctx, statCtxKeyStats, &probeProxy{creationTime: time.Now(), stats: s})
 }
@@ -161,9 +201,16 @@ type StatisticsData struct {
 	CacheSize              int        `json:"cache_size"`
 	HitCount               int        `json:"hit_count"`
 	MissCount              int        `json:"miss_count"`
+	HitRate                float64    `json:"hit_rate"`
 	SizeEvictCount         int        `json:"size_evict_count"`
 	AgeEvictCount          int        `json:"age_evict_count"`
+	CountEvictCount        int        `json:"count_evict_count"`
 	ReplaceCount           int        `json:"replace_count"`
+	DeleteCount            int        `json:"delete_count"`
+	SpillHitCount          int        `json:"spill_hit_count"`
+	SpillMissCount         int        `json:"spill_miss_count"`
+	SpillDatasetCount      int        `json:"spill_dataset_count"`
+	SpillSize              int        `json:"spill_size"`
 	StoreCount             int        `json:"store_count"`
 	StatisticsDuration     float64    `json:"statistics_duration"`
 	StatisticsBufferSize   int        `json:"statistics_buffer_size"`
@@ -186,25 +233,61 @@ func durationsToSeconds(d []time.Duration) []float64 {
 	return result
 }
 
+// mergeShards returns the data in all shards, the shards are reset.
+func (s *Statistics) mergeShards() StatisticsData {
+	stats := newStatisticsData(s.bufferSize)
+	for i := range s.shards {
+		data := s.shards[i].take()
+		stats.HitCount += data.HitCount
+		stats.MissCount += data.MissCount
+		stats.StoreCount += data.StoreCount
+		stats.QueryDurations = appendF(stats.QueryDurations, data.QueryDurations, s.bufferSize)
+		stats.TotalQueryDurations = appendF(stats.TotalQueryDurations, data.TotalQueryDurations, s.bufferSize)
+		stats.StoreDurations = appendF(stats.StoreDurations, data.StoreDurations, s.bufferSize)
+		stats.TotalStoreDurations = appendF(stats.TotalStoreDurations, data.TotalStoreDurations, s.bufferSize)
+		if room := s.bufferSize - len(stats.StoreRowCounts); room < len(data.StoreRowCounts) {
+			data.StoreRowCounts = data.StoreRowCounts[:room]
+		}
+		stats.StoreRowCounts = append(stats.StoreRowCounts, data.StoreRowCounts...)
+	}
+
+	return stats
+}
+
+// appendF appends the values in y to x, keeping at most size values.
+func appendF(x, y []float64, size int) []float64 {
+	if room := size - len(x); room < len(y) {
+		y = y[:room]
+	}
+	return append(x, y...)
+}
+
 func (s *Statistics) Stats() StatisticsData {
 	memStats := getMemstats()
-	newStatData := newStatisticsData(s.bufferSize)
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
 	now := time.Now()
 	cs := s.cache.Stats()
-	stats := s.data
+	stats := s.mergeShards()
 	stats.DatasetCount = cs.ItemCount
+	if queryCount := stats.HitCount + stats.MissCount; queryCount > 0 {
+		stats.HitRate = float64(stats.HitCount) / float64(queryCount)
+	}
 	stats.CacheSize = cs.ByteSize
 	stats.SizeEvictCount = cs.SizeEvictCount
 	stats.AgeEvictCount = cs.AgeEvictCount
+	stats.CountEvictCount = cs.CountEvictCount
 	stats.ReplaceCount = cs.ReplaceCount
+	stats.DeleteCount = cs.DeleteCount
+	stats.SpillHitCount = cs.SpillHitCount
+	stats.SpillMissCount = cs.SpillMissCount
+	stats.SpillDatasetCount = cs.SpillItemCount
+	stats.SpillSize = cs.SpillByteSize
 	stats.DurationsUntilEviction = durationsToSeconds(cs.TimeToEviction)
 	stats.StatisticsDuration = now.Sub(s.dataSince).Seconds()
 	stats.StatisticsBufferSize = s.bufferSize
 	stats.GoMemStats = memStats
-	s.data = newStatData
 	s.dataSince = now
 
 	return stats
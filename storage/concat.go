@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+)
+
+// Concat returns a new dataset with the rows of other appended to the rows of d.
+// Both frames must have the same columns, with the same types, but the column
+// order may differ. The column order of d is used in the result.
+//
+// enums optionally holds new enum definitions of the resulting enum columns. The
+// definitions of d are used otherwise. In that case other may only contain enum
+// values that are part of the definitions in d.
+func Concat(d Dataset, other qf.QFrame, enums map[string][]string) Dataset {
+	if err := firstErr(d.Frame.Err, other.Err); err != nil {
+		return errorDataset(err)
+	}
+
+	if err := checkSameSchema(d.Frame, other); err != nil {
+		return errorDataset(err)
+	}
+
+	enums, err := resolveEnums(d, other, enums)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	return concat(d.Frame, other, enums)
+}
+
+// concat concatenates f and other which must have the same schema. enums
+// must hold the enum definitions for all enum columns.
+func concat(f, other qf.QFrame, enums map[string][]string) Dataset {
+	fd, err := toFrameData(f, enums)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	otherFd, err := toFrameData(other.Select(f.ColumnNames()...), nil)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	for i := range fd.Columns {
+		c, otherC := &fd.Columns[i], otherFd.Columns[i]
+		c.Ints = append(c.Ints, otherC.Ints...)
+		c.Floats = append(c.Floats, otherC.Floats...)
+		c.Bools = append(c.Bools, otherC.Bools...)
+		c.Strings = append(c.Strings, otherC.Strings...)
+		c.Nulls = append(c.Nulls, otherC.Nulls...)
+	}
+
+	return fd.toDataset()
+}
+
+// resolveEnums returns the enum definitions of all enum columns in d. Definitions
+// not present in enums are taken from d, other must not contain any values not
+// present in those.
+func resolveEnums(d Dataset, other qf.QFrame, enums map[string][]string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	for name, typ := range d.Frame.ColumnTypeMap() {
+		if typ != types.Enum {
+			continue
+		}
+
+		if values, ok := enums[name]; ok {
+			result[name] = values
+			continue
+		}
+
+		values, ok := d.Enums[name]
+		if !ok {
+			return nil, fmt.Errorf("missing enum definition for column %s", name)
+		}
+
+		otherValues, err := presentEnumValues(other, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkEnumSubset(name, values, otherValues); err != nil {
+			return nil, err
+		}
+		result[name] = values
+	}
+
+	return result, nil
+}
+
+func checkSameSchema(f, other qf.QFrame) error {
+	typeMap, otherTypeMap := f.ColumnTypeMap(), other.ColumnTypeMap()
+	if len(typeMap) != len(otherTypeMap) {
+		return fmt.Errorf("column mismatch, expected columns %v, was %v", f.ColumnNames(), other.ColumnNames())
+	}
+
+	for name, typ := range typeMap {
+		otherTyp, ok := otherTypeMap[name]
+		if !ok {
+			return fmt.Errorf("column mismatch, expected columns %v, was %v", f.ColumnNames(), other.ColumnNames())
+		}
+
+		if typ != otherTyp {
+			return fmt.Errorf("type mismatch for column %s, expected %s, was %s", name, typ, otherTyp)
+		}
+	}
+
+	return nil
+}
+
+func checkEnumSubset(column string, values, otherValues []string) error {
+	valueSet := make(map[string]struct{}, len(values))
+	for _, v := range values {
+		valueSet[v] = struct{}{}
+	}
+
+	for _, v := range otherValues {
+		if _, ok := valueSet[v]; !ok {
+			return fmt.Errorf("unknown value %s for enum column %s, specify the enum values to add new values", v, column)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+)
+
+// Dataset is a QFrame together with the enum definitions of its enum columns.
+// qframe does not expose the enum definition of a column, only the values present
+// in the data, so the definitions are kept alongside the frame. They are needed
+// to keep values that are defined but not present in the data when the frame is
+// serialized or merged with other frames.
+type Dataset struct {
+	Frame qf.QFrame
+	Enums map[string][]string
+}
+
+// NewDataset returns a dataset holding f. enums holds the enum definitions of
+// the enum columns in f. Definitions that are missing, or that do not describe
+// the values present in the column, are replaced by the values present in the
+// column. This allows passing the definitions of the dataset that f was derived
+// from, columns that have been added or replaced get definitions of their own.
+func NewDataset(f qf.QFrame, enums map[string][]string) Dataset {
+	if f.Err != nil {
+		return Dataset{Frame: f}
+	}
+
+	result := make(map[string][]string)
+	for name, typ := range f.ColumnTypeMap() {
+		if typ != types.Enum {
+			continue
+		}
+
+		present, err := presentEnumValues(f, name)
+		if err != nil {
+			return errorDataset(err)
+		}
+
+		if values, ok := enums[name]; ok && definesEnum(values, present) {
+			result[name] = values
+		} else {
+			result[name] = present
+		}
+	}
+
+	return Dataset{Frame: f, Enums: result}
+}
+
+// WithFrame returns a dataset holding f, which must have been derived from the
+// frame in d without changing any enum columns, with the enum definitions of d.
+func (d Dataset) WithFrame(f qf.QFrame) Dataset {
+	return Dataset{Frame: f, Enums: d.Enums}
+}
+
+// ByteSize returns the approximate size of the dataset in bytes.
+func (d Dataset) ByteSize() int {
+	return d.Frame.ByteSize()
+}
+
+// definesEnum returns true if all values in present are part of values, in
+// the same order.
+func definesEnum(values, present []string) bool {
+	positions := make(map[string]int, len(values))
+	for i, v := range values {
+		positions[v] = i
+	}
+
+	last := -1
+	for _, v := range present {
+		pos, ok := positions[v]
+		if !ok || pos <= last {
+			return false
+		}
+		last = pos
+	}
+
+	return true
+}
+
+func errorDataset(err error) Dataset {
+	return Dataset{Frame: qf.QFrame{Err: err}}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"github.com/pierrec/lz4"
+	"github.com/tobgu/qocache/cache"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const diskFileSuffix = ".qf.lz4"
+
+// DiskTier is a cache.SpillTier that stores Datasets as lz4 compressed files in
+// a directory. When the total size of the files exceeds the max size the least
+// recently stored files are removed.
+type DiskTier struct {
+	lock        *sync.Mutex
+	dir         string
+	maxSize     int
+	currentSize int
+	keyMap      map[string]*list.Element
+	lruList     *list.List
+	fileSeq     int
+}
+
+type diskEntry struct {
+	meta     cache.Entry // Everything but the item itself, Item holds its FrameInfo
+	fileName string
+	size     int // Size of the file
+}
+
+// FrameInfo describes a Dataset stored on disk without having to read it.
+type FrameInfo struct {
+	RowCount int
+	Columns  []string
+}
+
+// NewDiskTier creates a new disk tier storing at most maxSize bytes in dir.
+// Any files left in dir by a previous disk tier are removed since the
+// information needed to use them is only kept in memory.
+func NewDiskTier(dir string, maxSize int) (*DiskTier, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	oldFiles, err := filepath.Glob(filepath.Join(dir, "*"+diskFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range oldFiles {
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DiskTier{
+		lock:    &sync.Mutex{},
+		dir:     dir,
+		maxSize: maxSize,
+		keyMap:  make(map[string]*list.Element),
+		lruList: list.New(),
+	}, nil
+}
+
+func (d *DiskTier) nextFileName() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.fileSeq++
+	return filepath.Join(d.dir, fmt.Sprintf("%d%s", d.fileSeq, diskFileSuffix))
+}
+
+func writeDatasetFile(fileName string, dataset Dataset) (int, error) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	lz4Writer := lz4.NewWriter(f)
+	bw := bufio.NewWriter(lz4Writer)
+	err = firstErr(WriteDataset(bw, dataset), bw.Flush(), lz4Writer.Close(), f.Close())
+	if err != nil {
+		_ = os.Remove(fileName)
+		return 0, err
+	}
+
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(info.Size()), nil
+}
+
+func readDatasetFile(fileName string) Dataset {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return errorDataset(err)
+	}
+	defer f.Close()
+
+	return ReadDataset(bufio.NewReader(lz4.NewReader(f)))
+}
+
+// Store writes entry, which must hold a Dataset, to disk.
+func (d *DiskTier) Store(entry cache.Entry) error {
+	dataset, ok := entry.Item.(Dataset)
+	if !ok {
+		return fmt.Errorf("cannot store %T on disk, only Datasets supported", entry.Item)
+	}
+
+	fileName := d.nextFileName()
+	size, err := writeDatasetFile(fileName, dataset)
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if size > d.maxSize {
+		_ = os.Remove(fileName)
+		return fmt.Errorf("cannot fit %d bytes on disk", size)
+	}
+
+	if elem, ok := d.keyMap[entry.Key]; ok {
+		d.remove(elem)
+	}
+
+	for d.currentSize+size > d.maxSize {
+		d.remove(d.lruList.Back())
+	}
+
+	entry.Item = FrameInfo{RowCount: dataset.Frame.Len(), Columns: dataset.Frame.ColumnNames()}
+	d.keyMap[entry.Key] = d.lruList.PushFront(&diskEntry{meta: entry, fileName: fileName, size: size})
+	d.currentSize += size
+	return nil
+}
+
+// Load reads the entry stored under key from disk and removes it from the tier.
+func (d *DiskTier) Load(key string) (cache.Entry, bool) {
+	d.lock.Lock()
+	elem, ok := d.keyMap[key]
+	if !ok {
+		d.lock.Unlock()
+		return cache.Entry{}, false
+	}
+
+	// Unlink the entry but keep the file until it has been read
+	entry := elem.Value.(*diskEntry)
+	delete(d.keyMap, key)
+	d.lruList.Remove(elem)
+	d.currentSize -= entry.size
+	d.lock.Unlock()
+
+	dataset := readDatasetFile(entry.fileName)
+	_ = os.Remove(entry.fileName)
+	if dataset.Frame.Err != nil {
+		return cache.Entry{}, false
+	}
+
+	result := entry.meta
+	result.Item = dataset
+	return result, true
+}
+
+// Delete removes the entry stored under key from disk.
+func (d *DiskTier) Delete(key string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	elem, ok := d.keyMap[key]
+	if ok {
+		d.remove(elem)
+	}
+
+	return ok
+}
+
+// Walk calls fn for each entry on disk, most recently stored first, with the
+// item read from disk, until fn returns false. Entries that are removed before
+// they have been read are skipped.
+func (d *DiskTier) Walk(fn func(cache.Entry) bool) {
+	d.lock.Lock()
+	entries := make([]diskEntry, 0, len(d.keyMap))
+	for elem := d.lruList.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, *elem.Value.(*diskEntry))
+	}
+	d.lock.Unlock()
+
+	for _, entry := range entries {
+		dataset := readDatasetFile(entry.fileName)
+		if dataset.Frame.Err != nil {
+			continue
+		}
+
+		result := entry.meta
+		result.Item = dataset
+		if !fn(result) {
+			return
+		}
+	}
+}
+
+// WalkMeta calls fn for each entry on disk, most recently stored first, until
+// fn returns false. The item is not read from disk, Item holds its FrameInfo.
+func (d *DiskTier) WalkMeta(fn func(cache.Entry) bool) {
+	d.lock.Lock()
+	entries := make([]cache.Entry, 0, len(d.keyMap))
+	for elem := d.lruList.Front(); elem != nil; elem = elem.Next() {
+		entries = append(entries, elem.Value.(*diskEntry).meta)
+	}
+	d.lock.Unlock()
+
+	for _, entry := range entries {
+		if !fn(entry) {
+			return
+		}
+	}
+}
+
+// EvictExpired removes all entries that have expired given maxAge.
+func (d *DiskTier) EvictExpired(maxAge time.Duration) int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	count := 0
+	for elem := d.lruList.Back(); elem != nil; {
+		prev := elem.Prev()
+		entry := elem.Value.(*diskEntry)
+		if entry.meta.HasExpired(maxAge) {
+			d.remove(elem)
+			count++
+		}
+		elem = prev
+	}
+
+	return count
+}
+
+// Stats returns the current size and number of entries on disk.
+func (d *DiskTier) Stats() cache.SpillStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return cache.SpillStats{ByteSize: d.currentSize, ItemCount: len(d.keyMap)}
+}
+
+func (d *DiskTier) remove(elem *list.Element) {
+	entry := elem.Value.(*diskEntry)
+	delete(d.keyMap, entry.meta.Key)
+	d.lruList.Remove(elem)
+	d.currentSize -= entry.size
+	_ = os.Remove(entry.fileName)
+}
@@ -0,0 +1,233 @@
+package storage
+
+import (
+	"encoding/gob"
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/config/groupby"
+	"github.com/tobgu/qframe/config/newqf"
+	"github.com/tobgu/qframe/types"
+	"io"
+	"sort"
+)
+
+// frameData is the serialized, column oriented, representation of a QFrame.
+type frameData struct {
+	Columns []columnData
+}
+
+type columnData struct {
+	Name    string
+	Type    string
+	Ints    []int
+	Floats  []float64
+	Bools   []bool
+	Strings []string
+	Nulls   []bool // String and enum columns only
+
+	// Enum columns only
+	EnumValues []string
+}
+
+func stringsToData(c *columnData, data []*string) {
+	c.Strings = make([]string, len(data))
+	c.Nulls = make([]bool, len(data))
+	for i, s := range data {
+		if s == nil {
+			c.Nulls[i] = true
+		} else {
+			c.Strings[i] = *s
+		}
+	}
+}
+
+func dataToStrings(c columnData) []*string {
+	result := make([]*string, len(c.Strings))
+	for i := range c.Strings {
+		if !c.Nulls[i] {
+			result[i] = &c.Strings[i]
+		}
+	}
+	return result
+}
+
+// presentEnumValues returns the distinct, non null, values of enum column col
+// in f in enum order.
+func presentEnumValues(f qf.QFrame, col string) ([]string, error) {
+	distinct := f.Select(col).Distinct(groupby.Columns(col)).Sort(qf.Order{Column: col})
+	view, err := distinct.EnumView(col)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]string, 0, view.Len())
+	for _, s := range view.Slice() {
+		if s != nil {
+			result = append(result, *s)
+		}
+	}
+
+	return result, nil
+}
+
+// ToEnum returns a new frame where the string column has been converted to an
+// enum column. The enum values are the distinct values in the column, sorted.
+// Since qframe cannot add an enum column to an existing frame the frame is
+// created anew from the views of its columns. Other enum columns keep the values
+// present in f as their enum values, see NewDataset.
+func ToEnum(f qf.QFrame, column string) qf.QFrame {
+	if f.Err != nil {
+		return f
+	}
+
+	typeMap := f.ColumnTypeMap()
+	if t := typeMap[column]; t == types.Enum {
+		return f
+	} else if t != types.String {
+		return qf.QFrame{Err: fmt.Errorf("cannot convert column %s of type %s to enum", column, t)}
+	}
+
+	data := make(map[string]types.DataSlice, len(typeMap))
+	enums := make(map[string][]string)
+	for name, typ := range typeMap {
+		switch typ {
+		case types.Int:
+			data[name] = f.MustIntView(name).Slice()
+		case types.Float:
+			data[name] = f.MustFloatView(name).Slice()
+		case types.Bool:
+			data[name] = f.MustBoolView(name).Slice()
+		case types.String:
+			data[name] = f.MustStringView(name).Slice()
+		case types.Enum:
+			values, err := presentEnumValues(f, name)
+			if err != nil {
+				return qf.QFrame{Err: err}
+			}
+			data[name] = f.MustEnumView(name).Slice()
+			enums[name] = values
+		}
+	}
+
+	enums[column] = distinctStrings(data[column].([]*string))
+	return qf.New(data, newqf.ColumnOrder(f.ColumnNames()...), newqf.Enums(enums))
+}
+
+// distinctStrings returns the distinct, non null, strings in input, sorted.
+func distinctStrings(input []*string) []string {
+	distinct := make(map[string]struct{})
+	for _, s := range input {
+		if s != nil {
+			distinct[*s] = struct{}{}
+		}
+	}
+
+	result := make([]string, 0, len(distinct))
+	for s := range distinct {
+		result = append(result, s)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// toFrameData returns the serialized representation of f. enums holds the enum
+// definitions of the enum columns in f, enum columns without a definition get
+// their enum values from the data when deserialized.
+func toFrameData(f qf.QFrame, enums map[string][]string) (frameData, error) {
+	if f.Err != nil {
+		return frameData{}, f.Err
+	}
+
+	typeMap := f.ColumnTypeMap()
+	result := frameData{Columns: make([]columnData, 0, len(typeMap))}
+	for _, name := range f.ColumnNames() {
+		c := columnData{Name: name, Type: string(typeMap[name])}
+		switch typeMap[name] {
+		case types.Int:
+			c.Ints = f.MustIntView(name).Slice()
+		case types.Float:
+			c.Floats = f.MustFloatView(name).Slice()
+		case types.Bool:
+			c.Bools = f.MustBoolView(name).Slice()
+		case types.String:
+			stringsToData(&c, f.MustStringView(name).Slice())
+		case types.Enum:
+			stringsToData(&c, f.MustEnumView(name).Slice())
+			c.EnumValues = enums[name]
+		default:
+			return frameData{}, fmt.Errorf("cannot serialize column %s of type %s", name, typeMap[name])
+		}
+		result.Columns = append(result.Columns, c)
+	}
+
+	return result, nil
+}
+
+func (fd frameData) toDataset() Dataset {
+	data := make(map[string]types.DataSlice, len(fd.Columns))
+	order := make([]string, 0, len(fd.Columns))
+	enums := make(map[string][]string)
+	for _, c := range fd.Columns {
+		order = append(order, c.Name)
+		switch c.Type {
+		case types.Int:
+			data[c.Name] = nonNilInts(c.Ints)
+		case types.Float:
+			data[c.Name] = nonNilFloats(c.Floats)
+		case types.Bool:
+			data[c.Name] = nonNilBools(c.Bools)
+		case types.String:
+			data[c.Name] = dataToStrings(c)
+		case types.Enum:
+			data[c.Name] = dataToStrings(c)
+			enums[c.Name] = c.EnumValues
+		default:
+			return errorDataset(fmt.Errorf("cannot deserialize column %s of type %s", c.Name, c.Type))
+		}
+	}
+
+	return Dataset{Frame: qf.New(data, newqf.ColumnOrder(order...), newqf.Enums(enums)), Enums: enums}
+}
+
+// gob decodes empty slices as nil, qframe needs typed slices to determine the column type.
+
+func nonNilInts(s []int) []int {
+	if s == nil {
+		return []int{}
+	}
+	return s
+}
+
+func nonNilFloats(s []float64) []float64 {
+	if s == nil {
+		return []float64{}
+	}
+	return s
+}
+
+func nonNilBools(s []bool) []bool {
+	if s == nil {
+		return []bool{}
+	}
+	return s
+}
+
+// WriteDataset writes d to w in a compact, column oriented, binary format.
+func WriteDataset(w io.Writer, d Dataset) error {
+	fd, err := toFrameData(d.Frame, d.Enums)
+	if err != nil {
+		return err
+	}
+
+	return gob.NewEncoder(w).Encode(fd)
+}
+
+// ReadDataset reads a dataset written by WriteDataset from r.
+func ReadDataset(r io.Reader) Dataset {
+	fd := frameData{}
+	if err := gob.NewDecoder(r).Decode(&fd); err != nil {
+		return errorDataset(err)
+	}
+
+	return fd.toDataset()
+}
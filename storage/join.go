@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"math"
+	"strconv"
+)
+
+type JoinType int
+
+const (
+	// InnerJoin only keeps rows with a match in both frames.
+	InnerJoin JoinType = iota
+
+	// LeftJoin keeps all rows in the left frame, columns from the right frame
+	// are null in rows without a match.
+	LeftJoin
+)
+
+// JoinOn pairs a column in the left frame with a column in the right frame
+// that should have equal values for rows to match.
+type JoinOn struct {
+	Left  string
+	Right string
+}
+
+// Join returns a new frame with the rows in left combined with the matching rows in
+// right. Rows with null values in any of the join columns never match. The order of
+// the rows in left is kept, rows with multiple matches are repeated once per match.
+//
+// The join columns from right are not included in the result. Other columns from
+// right with the same name as a column in left get prefix prepended to their name.
+//
+// Int and bool columns from right become float and string columns in left joins
+// where not all rows have a match, the same way as null values are handled in
+// query expressions. Enum columns keep the values present in the data as their
+// enum values, see NewDataset.
+func Join(left, right qf.QFrame, on []JoinOn, joinType JoinType, prefix string) qf.QFrame {
+	if err := firstErr(left.Err, right.Err); err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	if len(on) == 0 {
+		return qf.QFrame{Err: fmt.Errorf("at least one join column required")}
+	}
+
+	leftCols, rightCols := make([]string, len(on)), make([]string, len(on))
+	rightJoinCols := make(map[string]struct{}, len(on))
+	for i, o := range on {
+		leftCols[i], rightCols[i] = o.Left, o.Right
+		rightJoinCols[o.Right] = struct{}{}
+		if err := checkJoinTypes(left, right, o); err != nil {
+			return qf.QFrame{Err: err}
+		}
+	}
+
+	leftIndex, rightIndex, err := joinIndices(left, right, leftCols, rightCols, joinType)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	leftData, rightData := NewDataset(left, nil), NewDataset(right, nil)
+	leftFd, err := toFrameData(leftData.Frame, leftData.Enums)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	rightFd, err := toFrameData(rightData.Frame, rightData.Enums)
+	if err != nil {
+		return qf.QFrame{Err: err}
+	}
+
+	names := make(map[string]struct{})
+	result := frameData{Columns: make([]columnData, 0, len(leftFd.Columns)+len(rightFd.Columns))}
+	for _, c := range leftFd.Columns {
+		names[c.Name] = struct{}{}
+		result.Columns = append(result.Columns, gather(c, leftIndex))
+	}
+
+	for _, c := range rightFd.Columns {
+		if _, ok := rightJoinCols[c.Name]; ok {
+			continue
+		}
+
+		if _, ok := names[c.Name]; ok {
+			c.Name = prefix + c.Name
+			if _, ok := names[c.Name]; ok {
+				return qf.QFrame{Err: fmt.Errorf("column %s from joined frame already exists, use another prefix", c.Name)}
+			}
+		}
+
+		names[c.Name] = struct{}{}
+		result.Columns = append(result.Columns, gather(c, rightIndex))
+	}
+
+	return result.toDataset().Frame
+}
+
+func isStringType(t types.DataType) bool {
+	return t == types.String || t == types.Enum
+}
+
+func checkJoinTypes(left, right qf.QFrame, on JoinOn) error {
+	leftType, ok := left.ColumnTypeMap()[on.Left]
+	if !ok {
+		return fmt.Errorf("unknown join column: %s", on.Left)
+	}
+
+	rightType, ok := right.ColumnTypeMap()[on.Right]
+	if !ok {
+		return fmt.Errorf("unknown join column in joined frame: %s", on.Right)
+	}
+
+	if leftType != rightType && !(isStringType(leftType) && isStringType(rightType)) {
+		return fmt.Errorf("cannot join column %s of type %s with column %s of type %s", on.Left, leftType, on.Right, rightType)
+	}
+
+	return nil
+}
+
+// joinIndices returns the row numbers in left and right of the rows in the
+// joined frame. The right row number is -1 for rows without a match.
+func joinIndices(left, right qf.QFrame, leftCols, rightCols []string, joinType JoinType) ([]int, []int, error) {
+	rightKeys, rightNulls, err := RowKeys(right, rightCols)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rightRows := make(map[string][]int, len(rightKeys))
+	for i, k := range rightKeys {
+		if !rightNulls[i] {
+			rightRows[k] = append(rightRows[k], i)
+		}
+	}
+
+	leftKeys, leftNulls, err := RowKeys(left, leftCols)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	leftIndex, rightIndex := make([]int, 0, len(leftKeys)), make([]int, 0, len(leftKeys))
+	for i, k := range leftKeys {
+		var matches []int
+		if !leftNulls[i] {
+			matches = rightRows[k]
+		}
+
+		for _, m := range matches {
+			leftIndex = append(leftIndex, i)
+			rightIndex = append(rightIndex, m)
+		}
+
+		if len(matches) == 0 && joinType == LeftJoin {
+			leftIndex = append(leftIndex, i)
+			rightIndex = append(rightIndex, -1)
+		}
+	}
+
+	return leftIndex, rightIndex, nil
+}
+
+// gather returns a new column with the rows in c given by index. A negative
+// index results in a null value, see Join for how this affects the column type.
+func gather(c columnData, index []int) columnData {
+	hasNull := false
+	for _, ix := range index {
+		if ix < 0 {
+			hasNull = true
+			break
+		}
+	}
+
+	result := columnData{Name: c.Name, Type: c.Type, EnumValues: c.EnumValues}
+	switch {
+	case c.Type == types.Int && hasNull:
+		result.Type = types.Float
+		result.Floats = make([]float64, len(index))
+		for i, ix := range index {
+			if ix < 0 {
+				result.Floats[i] = math.NaN()
+			} else {
+				result.Floats[i] = float64(c.Ints[ix])
+			}
+		}
+	case c.Type == types.Int:
+		result.Ints = make([]int, len(index))
+		for i, ix := range index {
+			result.Ints[i] = c.Ints[ix]
+		}
+	case c.Type == types.Float:
+		result.Floats = make([]float64, len(index))
+		for i, ix := range index {
+			if ix < 0 {
+				result.Floats[i] = math.NaN()
+			} else {
+				result.Floats[i] = c.Floats[ix]
+			}
+		}
+	case c.Type == types.Bool && hasNull:
+		result.Type = types.String
+		result.Strings = make([]string, len(index))
+		result.Nulls = make([]bool, len(index))
+		for i, ix := range index {
+			if ix < 0 {
+				result.Nulls[i] = true
+			} else {
+				result.Strings[i] = strconv.FormatBool(c.Bools[ix])
+			}
+		}
+	case c.Type == types.Bool:
+		result.Bools = make([]bool, len(index))
+		for i, ix := range index {
+			result.Bools[i] = c.Bools[ix]
+		}
+	default:
+		result.Strings = make([]string, len(index))
+		result.Nulls = make([]bool, len(index))
+		for i, ix := range index {
+			if ix < 0 {
+				result.Nulls[i] = true
+			} else {
+				result.Strings[i] = c.Strings[ix]
+				result.Nulls[i] = c.Nulls[ix]
+			}
+		}
+	}
+
+	return result
+}
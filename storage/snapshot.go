@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"github.com/tobgu/qocache/cache"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const snapshotFileName = "qocache.snapshot"
+
+type snapshotEntry struct {
+	Key        string
+	CreateTime time.Time
+	TTL        time.Duration
+	Frame      frameData
+}
+
+// WriteSnapshot writes all datasets in c to a snapshot file in dir. The file
+// is written atomically, replacing any previous snapshot.
+// Returns the number of datasets written.
+func WriteSnapshot(dir string, c cache.Cache) (int, error) {
+	tmp, err := os.CreateTemp(dir, snapshotFileName+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	count, err := writeSnapshotEntries(tmp, c)
+	if err = firstErr(err, tmp.Close()); err != nil {
+		return 0, err
+	}
+
+	return count, os.Rename(tmp.Name(), filepath.Join(dir, snapshotFileName))
+}
+
+func writeSnapshotEntries(w io.Writer, c cache.Cache) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := gob.NewEncoder(bw)
+	count := 0
+	var err error
+	c.Walk(func(entry cache.Entry) bool {
+		dataset, ok := entry.Item.(Dataset)
+		if !ok {
+			return true
+		}
+
+		var fd frameData
+		fd, err = toFrameData(dataset.Frame, dataset.Enums)
+		if err != nil {
+			err = fmt.Errorf("could not serialize dataset %s: %v", entry.Key, err)
+			return false
+		}
+
+		err = enc.Encode(snapshotEntry{Key: entry.Key, CreateTime: entry.CreateTime, TTL: entry.TTL, Frame: fd})
+		if err != nil {
+			return false
+		}
+		count++
+		return true
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, bw.Flush()
+}
+
+// RestoreSnapshot reads the datasets in the snapshot file in dir, if any, into c.
+// Datasets keep their creation time and TTL, already expired datasets are skipped.
+// Datasets that cannot be restored are skipped as well, the returned error then
+// tells how many and why. The snapshot file is removed once read, also if datasets
+// were skipped, to avoid restoring stale data more than once. Returns the number of
+// datasets restored.
+func RestoreSnapshot(dir string, c cache.Cache) (int, error) {
+	path := filepath.Join(dir, snapshotFileName)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	count, err := restoreSnapshotEntries(f, c)
+	return count, firstErr(err, f.Close(), os.Remove(path))
+}
+
+func restoreSnapshotEntries(r io.Reader, c cache.Cache) (int, error) {
+	dec := gob.NewDecoder(bufio.NewReader(r))
+	count, skipped := 0, 0
+	var skipErr error
+	skip := func(err error) {
+		if skipErr == nil {
+			skipErr = err
+		}
+		skipped++
+	}
+
+	for {
+		entry := snapshotEntry{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// The rest of the file cannot be trusted
+			return count, err
+		}
+
+		dataset := entry.Frame.toDataset()
+		if dataset.Frame.Err != nil {
+			skip(fmt.Errorf("could not deserialize dataset %s: %v", entry.Key, dataset.Frame.Err))
+			continue
+		}
+
+		restored, err := c.Restore(cache.Entry{Key: entry.Key, Item: dataset, ByteSize: dataset.ByteSize(), CreateTime: entry.CreateTime, TTL: entry.TTL})
+		if err != nil {
+			skip(fmt.Errorf("could not restore dataset %s: %v", entry.Key, err))
+			continue
+		}
+
+		if restored {
+			count++
+		}
+	}
+
+	if skipped > 0 {
+		return count, fmt.Errorf("skipped %d datasets, first error: %v", skipped, skipErr)
+	}
+
+	return count, nil
+}
+
+func firstErr(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
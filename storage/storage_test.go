@@ -0,0 +1,488 @@
+package storage_test
+
+import (
+	"bytes"
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/config/newqf"
+	"github.com/tobgu/qframe/types"
+	"github.com/tobgu/qocache/cache"
+	"github.com/tobgu/qocache/storage"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func assertNotErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func assertEquals(t *testing.T, expected, actual interface{}) {
+	t.Helper()
+	if expected != actual {
+		t.Errorf("%v != %v", expected, actual)
+	}
+}
+
+func assertFramesEqual(t *testing.T, expected, actual qf.QFrame) {
+	t.Helper()
+	if equal, reason := expected.Equals(actual); !equal {
+		t.Errorf("Frames not equal: %s\n%s\n%s", reason, expected, actual)
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+var testEnums = map[string][]string{"E": {"medium", "low", "high"}}
+
+func testFrame() qf.QFrame {
+	return qf.New(map[string]types.DataSlice{
+		"I": []int{1, 2, 3},
+		"F": []float64{1.5, math.NaN(), 3.5},
+		"B": []bool{true, false, true},
+		"S": []*string{strPtr("a"), nil, strPtr("")},
+		"E": []*string{strPtr("high"), strPtr("low"), nil},
+	}, newqf.ColumnOrder("S", "I", "F", "B", "E"), newqf.Enums(testEnums))
+}
+
+func testDataset() storage.Dataset {
+	return storage.NewDataset(testFrame(), testEnums)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	frames := map[string]qf.QFrame{
+		"All types": testFrame(),
+		"Filtered":  testFrame().Filter(qf.Filter{Column: "I", Comparator: ">", Arg: 1}),
+		"Empty": qf.New(map[string]types.DataSlice{
+			"I": []int{}, "F": []float64{}, "B": []bool{}, "S": []*string{}}),
+	}
+
+	for name, frame := range frames {
+		t.Run(name, func(t *testing.T) {
+			assertNotErr(t, frame.Err)
+			buf := new(bytes.Buffer)
+			assertNotErr(t, storage.WriteDataset(buf, storage.NewDataset(frame, testEnums)))
+			result := storage.ReadDataset(buf).Frame
+			assertNotErr(t, result.Err)
+			assertFramesEqual(t, frame, result)
+			assertEquals(t, frame.ColumnTypeMap()["E"], result.ColumnTypeMap()["E"])
+		})
+	}
+}
+
+func TestEnumOrderIsKeptInRoundTrip(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assertNotErr(t, storage.WriteDataset(buf, testDataset()))
+	result := storage.ReadDataset(buf).Frame.Sort(qf.Order{Column: "E"})
+	assertNotErr(t, result.Err)
+
+	// Null first, then the defined enum order
+	view := result.MustEnumView("E")
+	assertEquals(t, true, view.ItemAt(0) == nil)
+	assertEquals(t, "low", *view.ItemAt(1))
+	assertEquals(t, "high", *view.ItemAt(2))
+
+	// Values defined but not present in the data are kept
+	filtered := result.Filter(qf.Filter{Column: "E", Comparator: "<", Arg: "low"})
+	assertNotErr(t, filtered.Err)
+	assertEquals(t, 0, filtered.Len())
+	filtered = result.Filter(qf.Filter{Column: "E", Comparator: ">", Arg: "medium"})
+	assertNotErr(t, filtered.Err)
+	assertEquals(t, 2, filtered.Len())
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	c := cache.New(1000000, time.Hour)
+	dataset := testDataset()
+	assertNotErr(t, c.Put("default", dataset, dataset.ByteSize()))
+	assertNotErr(t, c.PutWithTTL("ttl", dataset, dataset.ByteSize(), 2*time.Hour))
+	assertNotErr(t, c.PutWithTTL("expired", dataset, dataset.ByteSize(), time.Millisecond))
+	assertNotErr(t, c.Put("other", "not a frame", 10))
+	time.Sleep(2 * time.Millisecond)
+
+	count, err := storage.WriteSnapshot(dir, c)
+	assertNotErr(t, err)
+	assertEquals(t, 2, count)
+
+	restored := cache.New(1000000, time.Hour)
+	count, err = storage.RestoreSnapshot(dir, restored)
+	assertNotErr(t, err)
+	assertEquals(t, 2, count)
+
+	for _, key := range []string{"default", "ttl"} {
+		item, ok := restored.Get(key)
+		assertEquals(t, true, ok)
+		assertFramesEqual(t, dataset.Frame, item.(storage.Dataset).Frame)
+		assertEquals(t, "medium,low,high", strings.Join(item.(storage.Dataset).Enums["E"], ","))
+	}
+
+	original := map[string]cache.Entry{}
+	for _, e := range c.Entries() {
+		original[e.Key] = e
+	}
+
+	for _, e := range restored.Entries() {
+		assertEquals(t, true, original[e.Key].CreateTime.Equal(e.CreateTime))
+		assertEquals(t, original[e.Key].TTL, e.TTL)
+	}
+
+	// The snapshot is removed once restored
+	_, err = os.Stat(filepath.Join(dir, "qocache.snapshot"))
+	assertEquals(t, true, os.IsNotExist(err))
+	count, err = storage.RestoreSnapshot(dir, restored)
+	assertNotErr(t, err)
+	assertEquals(t, 0, count)
+}
+
+func TestSnapshotIncludesSpilledDatasets(t *testing.T) {
+	dir := t.TempDir()
+	tier, err := storage.NewDiskTier(filepath.Join(dir, "spill"), 1000000)
+	assertNotErr(t, err)
+	c := cache.NewWithPolicy(1000000, 1, time.Hour, cache.NewLruPolicy())
+	c.SetSpillTier(tier)
+
+	dataset := testDataset()
+	assertNotErr(t, c.Put("a", dataset, dataset.ByteSize()))
+	assertNotErr(t, c.Put("b", dataset, dataset.ByteSize()))
+	assertEquals(t, 1, tier.Stats().ItemCount)
+
+	count, err := storage.WriteSnapshot(dir, c)
+	assertNotErr(t, err)
+	assertEquals(t, 2, count)
+
+	restored := cache.New(1000000, time.Hour)
+	count, err = storage.RestoreSnapshot(dir, restored)
+	assertNotErr(t, err)
+	assertEquals(t, 2, count)
+	for _, key := range []string{"a", "b"} {
+		item, ok := restored.Get(key)
+		assertEquals(t, true, ok)
+		assertFramesEqual(t, dataset.Frame, item.(storage.Dataset).Frame)
+	}
+}
+
+// failingCache fails to restore the entry stored under key "bad".
+type failingCache struct {
+	*cache.LruCache
+}
+
+func (c failingCache) Restore(entry cache.Entry) (bool, error) {
+	if entry.Key == "bad" {
+		return false, fmt.Errorf("failed")
+	}
+	return c.LruCache.Restore(entry)
+}
+
+func TestRestoreSnapshotSkipsBadDatasets(t *testing.T) {
+	dir := t.TempDir()
+	c := cache.New(1000000, time.Hour)
+	dataset := testDataset()
+	for _, key := range []string{"a", "bad", "c"} {
+		assertNotErr(t, c.Put(key, dataset, dataset.ByteSize()))
+	}
+
+	_, err := storage.WriteSnapshot(dir, c)
+	assertNotErr(t, err)
+
+	restored := failingCache{cache.New(1000000, time.Hour)}
+	count, err := storage.RestoreSnapshot(dir, restored)
+	assertEquals(t, true, err != nil)
+	assertEquals(t, 2, count)
+	_, ok := restored.Get("c")
+	assertEquals(t, true, ok)
+}
+
+func TestDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	tier, err := storage.NewDiskTier(dir, 1000000)
+	assertNotErr(t, err)
+
+	dataset := testDataset()
+	frame := dataset.Frame
+	createTime := time.Now().Add(-time.Minute)
+	entry := cache.Entry{Key: "a", Item: dataset, ByteSize: frame.ByteSize(), CreateTime: createTime, TTL: time.Hour}
+	assertNotErr(t, tier.Store(entry))
+	assertNotErr(t, tier.Store(cache.Entry{Key: "b", Item: dataset, ByteSize: frame.ByteSize(), CreateTime: time.Now()}))
+	assertEquals(t, true, tier.Store(cache.Entry{Key: "c", Item: "not a frame"}) != nil)
+	assertEquals(t, 2, tier.Stats().ItemCount)
+
+	// Walking the metadata only gives information about the frames, not the frames
+	infos := make(map[string]storage.FrameInfo)
+	tier.WalkMeta(func(e cache.Entry) bool {
+		infos[e.Key] = e.Item.(storage.FrameInfo)
+		return true
+	})
+	assertEquals(t, 2, len(infos))
+	assertEquals(t, frame.Len(), infos["a"].RowCount)
+	assertEquals(t, strings.Join(frame.ColumnNames(), ","), strings.Join(infos["a"].Columns, ","))
+
+	loaded, ok := tier.Load("a")
+	assertEquals(t, true, ok)
+	assertFramesEqual(t, frame, loaded.Item.(storage.Dataset).Frame)
+	assertEquals(t, true, loaded.CreateTime.Equal(createTime))
+	assertEquals(t, time.Hour, loaded.TTL)
+	assertEquals(t, frame.ByteSize(), loaded.ByteSize)
+
+	// Loading removes the entry from disk
+	_, ok = tier.Load("a")
+	assertEquals(t, false, ok)
+	assertEquals(t, true, tier.Delete("b"))
+	assertEquals(t, false, tier.Delete("b"))
+
+	stats := tier.Stats()
+	assertEquals(t, 0, stats.ItemCount)
+	assertEquals(t, 0, stats.ByteSize)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	assertEquals(t, 0, len(files))
+}
+
+func TestDiskTierRespectsMaxSize(t *testing.T) {
+	dataset := testDataset()
+	dir := t.TempDir()
+	tier, err := storage.NewDiskTier(dir, 1000000)
+	assertNotErr(t, err)
+	assertNotErr(t, tier.Store(cache.Entry{Key: "a", Item: dataset}))
+	fileSize := tier.Stats().ByteSize
+
+	// Room for two files, the least recently stored is removed
+	tier, err = storage.NewDiskTier(dir, 2*fileSize+fileSize/2)
+	assertNotErr(t, err)
+	assertEquals(t, 0, tier.Stats().ItemCount)
+	for _, key := range []string{"a", "b", "c"} {
+		assertNotErr(t, tier.Store(cache.Entry{Key: key, Item: dataset}))
+	}
+
+	assertEquals(t, 2, tier.Stats().ItemCount)
+	_, ok := tier.Load("a")
+	assertEquals(t, false, ok)
+	_, ok = tier.Load("c")
+	assertEquals(t, true, ok)
+
+	tier, err = storage.NewDiskTier(dir, fileSize/2)
+	assertNotErr(t, err)
+	assertEquals(t, true, tier.Store(cache.Entry{Key: "a", Item: dataset}) != nil)
+}
+
+func TestDiskTierEvictExpired(t *testing.T) {
+	tier, err := storage.NewDiskTier(t.TempDir(), 1000000)
+	assertNotErr(t, err)
+	dataset := testDataset()
+	assertNotErr(t, tier.Store(cache.Entry{Key: "a", Item: dataset, CreateTime: time.Now().Add(-2 * time.Hour)}))
+	assertNotErr(t, tier.Store(cache.Entry{Key: "b", Item: dataset, CreateTime: time.Now()}))
+	assertNotErr(t, tier.Store(cache.Entry{Key: "c", Item: dataset, CreateTime: time.Now().Add(-2 * time.Hour), TTL: 3 * time.Hour}))
+
+	assertEquals(t, 1, tier.EvictExpired(time.Hour))
+	assertEquals(t, 2, tier.Stats().ItemCount)
+	_, ok := tier.Load("a")
+	assertEquals(t, false, ok)
+}
+
+func TestCacheWithDiskTierConcurrently(t *testing.T) {
+	tier, err := storage.NewDiskTier(t.TempDir(), 100000000)
+	assertNotErr(t, err)
+
+	// Room for two entries in memory, the rest are spilled to disk
+	c := cache.NewWithPolicy(100000000, 2, 0, cache.NewLruPolicy())
+	c.SetSpillTier(tier)
+
+	// Interleave the goroutines also on machines with few cores
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	// Each goroutine owns a key and checks that it always reads back what it
+	// last wrote while the other goroutines evict its entry.
+	errs := make(chan error, 8)
+	wg := sync.WaitGroup{}
+	for g := 0; g < cap(errs); g++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				// Large enough for writing to disk to take a while
+				values := make([]int, 10000)
+				for j := range values {
+					values[j] = i
+				}
+				dataset := storage.NewDataset(qf.New(map[string]interface{}{"I": values}), nil)
+				if err := c.Put(key, dataset, dataset.ByteSize()); err != nil {
+					errs <- err
+					return
+				}
+
+				item, ok := c.Get(key)
+				if !ok {
+					errs <- fmt.Errorf("%s: not found after put %d", key, i)
+					return
+				}
+
+				if v := item.(storage.Dataset).Frame.MustIntView("I").ItemAt(0); v != i {
+					errs <- fmt.Errorf("%s: expected %d, was %d", key, i, v)
+					return
+				}
+
+				if i%10 == 9 {
+					if !c.Delete(key) {
+						errs <- fmt.Errorf("%s: not found on delete %d", key, i)
+						return
+					}
+
+					if _, ok := c.Get(key); ok {
+						errs <- fmt.Errorf("%s: found after delete %d", key, i)
+						return
+					}
+				}
+			}
+		}(fmt.Sprintf("key%d", g))
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	d := testDataset()
+	f := d.Frame
+	other := testFrame().Select("I", "F", "B", "E", "S").Filter(qf.Filter{Column: "I", Comparator: "<", Arg: 3})
+	result := storage.Concat(d, other, nil).Frame
+	assertNotErr(t, result.Err)
+	assertEquals(t, 5, result.Len())
+	assertEquals(t, "S", result.ColumnNames()[0])
+	assertFramesEqual(t, f, result.Slice(0, 3))
+	assertFramesEqual(t, other.Select(f.ColumnNames()...), result.Slice(3, 5))
+	assertEquals(t, types.DataType(types.Enum), result.ColumnTypeMap()["E"])
+
+	assertEquals(t, true, storage.Concat(d, f.Drop("I"), nil).Frame.Err != nil)
+	assertEquals(t, true, storage.Concat(storage.NewDataset(f.Drop("I"), testEnums), f.Drop("F"), nil).Frame.Err != nil)
+	otherTypes := f.Drop("I").Eval("I", qf.Val("a"))
+	assertEquals(t, true, storage.Concat(d, otherTypes, nil).Frame.Err != nil)
+}
+
+func TestConcatEnums(t *testing.T) {
+	enums := map[string][]string{"E": {"low", "medium", "high"}}
+	d := storage.NewDataset(qf.New(map[string]types.DataSlice{"E": []string{"high", "low"}}, newqf.Enums(enums)), enums)
+	other := qf.New(map[string]types.DataSlice{"E": []string{"medium"}}, newqf.Enums(enums))
+
+	// Enum values defined, but not present, in d are accepted
+	result := storage.Concat(d, other, nil)
+	assertNotErr(t, result.Frame.Err)
+	assertEquals(t, "medium", *result.Frame.Sort(qf.Order{Column: "E"}).MustEnumView("E").ItemAt(1))
+	assertEquals(t, "low,medium,high", strings.Join(result.Enums["E"], ","))
+
+	// Enum values not defined in d are only accepted if the enum values are given
+	extendedEnums := map[string][]string{"E": {"low", "medium", "high", "extreme"}}
+	other = qf.New(map[string]types.DataSlice{"E": []string{"extreme"}}, newqf.Enums(extendedEnums))
+	assertEquals(t, true, storage.Concat(d, other, nil).Frame.Err != nil)
+	result = storage.Concat(d, other, extendedEnums)
+	assertNotErr(t, result.Frame.Err)
+	assertEquals(t, "extreme", *result.Frame.Sort(qf.Order{Column: "E"}).MustEnumView("E").ItemAt(2))
+	assertEquals(t, "low,medium,high,extreme", strings.Join(result.Enums["E"], ","))
+
+	result = storage.Concat(d, d.Frame, nil)
+	assertNotErr(t, result.Frame.Err)
+	assertEquals(t, 4, result.Frame.Len())
+}
+
+func TestNewDataset(t *testing.T) {
+	f := testFrame()
+
+	// Definitions that describe the data are kept
+	assertEquals(t, "medium,low,high", strings.Join(storage.NewDataset(f, testEnums).Enums["E"], ","))
+
+	// Missing definitions, or definitions that do not describe the data, are
+	// replaced by the values present in the data in enum order
+	assertEquals(t, "low,high", strings.Join(storage.NewDataset(f, nil).Enums["E"], ","))
+	wrongOrder := map[string][]string{"E": {"high", "medium", "low"}}
+	assertEquals(t, "low,high", strings.Join(storage.NewDataset(f, wrongOrder).Enums["E"], ","))
+	missingValue := map[string][]string{"E": {"medium", "high"}}
+	assertEquals(t, "low,high", strings.Join(storage.NewDataset(f, missingValue).Enums["E"], ","))
+	assertEquals(t, 1, len(storage.NewDataset(f, nil).Enums))
+}
+
+func TestUpsert(t *testing.T) {
+	d := testDataset()
+	f := d.Frame
+	other := qf.New(map[string]types.DataSlice{
+		"I": []int{3, 4},
+		"F": []float64{5.5, 6.5},
+		"B": []bool{false, false},
+		"S": []*string{strPtr(""), nil},
+		"E": []*string{strPtr("low"), nil},
+	}, newqf.Enums(testEnums))
+
+	// Multiple key columns, including one with nulls
+	result := storage.Upsert(d, other, []string{"S", "I"}, nil).Frame
+	assertNotErr(t, result.Err)
+	assertEquals(t, 4, result.Len())
+	assertFramesEqual(t, f.Slice(0, 2), result.Slice(0, 2))
+	assertFramesEqual(t, other.Select(f.ColumnNames()...), result.Slice(2, 4))
+
+	result = storage.Upsert(d, other, []string{"E"}, nil).Frame
+	assertNotErr(t, result.Err)
+	assertEquals(t, 3, result.Len())
+	assertEquals(t, 1, result.MustIntView("I").ItemAt(0))
+
+	assertEquals(t, true, storage.Upsert(d, other, []string{}, nil).Frame.Err != nil)
+	assertEquals(t, true, storage.Upsert(d, other, []string{"X"}, nil).Frame.Err != nil)
+	assertEquals(t, true, storage.Upsert(d, other, []string{"B"}, nil).Frame.Err != nil)
+}
+
+func TestJoin(t *testing.T) {
+	left := qf.New(map[string]types.DataSlice{
+		"id":   []int{1, 2, 3, 2},
+		"name": []*string{strPtr("a"), strPtr("b"), strPtr("c"), nil},
+		"v":    []float64{1.5, 2.5, 3.5, 4.5},
+	}, newqf.ColumnOrder("id", "name", "v"))
+	right := qf.New(map[string]types.DataSlice{
+		"ref_id": []int{2, 1, 1},
+		"v":      []int{20, 10, 11},
+		"b":      []bool{true, false, true},
+		"e":      []*string{strPtr("x"), nil, strPtr("y")},
+	}, newqf.ColumnOrder("ref_id", "v", "b", "e"), newqf.Enums(map[string][]string{"e": {"y", "x"}}))
+	on := []storage.JoinOn{{Left: "id", Right: "ref_id"}}
+
+	result := storage.Join(left, right, on, storage.InnerJoin, "r_")
+	assertNotErr(t, result.Err)
+	expected := qf.New(map[string]types.DataSlice{
+		"id":   []int{1, 1, 2, 2},
+		"name": []*string{strPtr("a"), strPtr("a"), strPtr("b"), nil},
+		"v":    []float64{1.5, 1.5, 2.5, 4.5},
+		"r_v":  []int{10, 11, 20, 20},
+		"b":    []bool{false, true, true, true},
+		"e":    []*string{nil, strPtr("y"), strPtr("x"), strPtr("x")},
+	}, newqf.ColumnOrder("id", "name", "v", "r_v", "b", "e"), newqf.Enums(map[string][]string{"e": {"y", "x"}}))
+	assertFramesEqual(t, expected, result)
+	assertEquals(t, types.DataType(types.Enum), result.ColumnTypeMap()["e"])
+
+	// Unmatched rows are kept with null values in left joins, int and bool columns change type
+	result = storage.Join(left, right, on, storage.LeftJoin, "r_")
+	assertNotErr(t, result.Err)
+	assertEquals(t, 5, result.Len())
+	assertEquals(t, types.DataType(types.Float), result.ColumnTypeMap()["r_v"])
+	assertEquals(t, types.DataType(types.String), result.ColumnTypeMap()["b"])
+	assertEquals(t, 3, result.MustIntView("id").ItemAt(3))
+	assertEquals(t, true, math.IsNaN(result.MustFloatView("r_v").ItemAt(3)))
+	assertEquals(t, true, result.MustStringView("b").ItemAt(3) == nil)
+
+	// Null values never match
+	result = storage.Join(left, left, []storage.JoinOn{{Left: "name", Right: "name"}}, storage.InnerJoin, "r_")
+	assertNotErr(t, result.Err)
+	assertEquals(t, 3, result.Len())
+
+	assertEquals(t, true, storage.Join(left, right, nil, storage.InnerJoin, "r_").Err != nil)
+	assertEquals(t, true, storage.Join(left, right, []storage.JoinOn{{Left: "id", Right: "x"}}, storage.InnerJoin, "r_").Err != nil)
+	assertEquals(t, true, storage.Join(left, right, []storage.JoinOn{{Left: "v", Right: "v"}}, storage.InnerJoin, "r_").Err != nil)
+	assertEquals(t, true, storage.Join(left, right, on, storage.InnerJoin, "").Err != nil)
+}
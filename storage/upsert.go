@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"fmt"
+	qf "github.com/tobgu/qframe"
+	"github.com/tobgu/qframe/types"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const upsertRowNumColumn = "__qocache_row_num"
+
+// Upsert returns a new dataset where the rows of d that have the same values in
+// keyColumns as a row in other have been replaced by that row. Rows in other
+// with keys that are not present in d are added. Replaced rows are not kept in
+// place, all rows from other are added after the remaining rows of d.
+//
+// The schema of the frames must match, see Concat. Keys must be unique in other.
+func Upsert(d Dataset, other qf.QFrame, keyColumns []string, enums map[string][]string) Dataset {
+	f := d.Frame
+	if err := firstErr(f.Err, other.Err); err != nil {
+		return errorDataset(err)
+	}
+
+	if len(keyColumns) == 0 {
+		return errorDataset(fmt.Errorf("at least one key column required for upsert"))
+	}
+
+	if err := checkSameSchema(f, other); err != nil {
+		return errorDataset(err)
+	}
+
+	enums, err := resolveEnums(d, other, enums)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	otherKeys, _, err := RowKeys(other, keyColumns)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	keySet := make(map[string]struct{}, len(otherKeys))
+	for _, k := range otherKeys {
+		if _, ok := keySet[k]; ok {
+			return errorDataset(fmt.Errorf("duplicate key in upserted rows, key columns: %v", keyColumns))
+		}
+		keySet[k] = struct{}{}
+	}
+
+	keys, _, err := RowKeys(f, keyColumns)
+	if err != nil {
+		return errorDataset(err)
+	}
+
+	replaced := make([]int, 0)
+	for i, k := range keys {
+		if _, ok := keySet[k]; ok {
+			replaced = append(replaced, i)
+		}
+	}
+
+	if len(replaced) > 0 {
+		f = f.WithRowNums(upsertRowNumColumn).
+			Filter(qf.Filter{Column: upsertRowNumColumn, Comparator: "in", Arg: replaced, Inverse: true}).
+			Drop(upsertRowNumColumn)
+	}
+
+	return concat(f, other, enums)
+}
+
+// RowKeys returns a string per row in f that uniquely identifies the
+// combination of values in columns. String and enum values with the same
+// contents get the same key. Also returns whether any of the values in
+// each row is null.
+func RowKeys(f qf.QFrame, columns []string) ([]string, []bool, error) {
+	fd, err := toFrameData(f.Select(columns...), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hasNull := make([]bool, f.Len())
+	builders := make([]strings.Builder, f.Len())
+	for _, c := range fd.Columns {
+		for i := range builders {
+			b := &builders[i]
+			switch c.Type {
+			case types.Int:
+				b.WriteString(strconv.Itoa(c.Ints[i]))
+			case types.Float:
+				b.WriteString(strconv.FormatFloat(c.Floats[i], 'g', -1, 64))
+				hasNull[i] = hasNull[i] || math.IsNaN(c.Floats[i])
+			case types.Bool:
+				b.WriteString(strconv.FormatBool(c.Bools[i]))
+			default:
+				// Length prefix to avoid ambiguities between values and separators
+				if c.Nulls[i] {
+					b.WriteString("null")
+					hasNull[i] = true
+				} else {
+					b.WriteString(strconv.Itoa(len(c.Strings[i])))
+					b.WriteByte(':')
+					b.WriteString(c.Strings[i])
+				}
+			}
+			b.WriteByte(';')
+		}
+	}
+
+	result := make([]string, len(builders))
+	for i := range builders {
+		result[i] = builders[i].String()
+	}
+
+	return result, hasNull, nil
+}